@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (h *apiHandler) serveDeleteUser(ctx context.Context, w http.ResponseWriter, r *deleteUserRqst, uid string) {
+	deleted, wait, ok := h.deleteUser(ctx, uid, r.Password)
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if deleted {
+		h.writeDeleteCookie(w)
+	}
+	writeJSON(w, &deleteUserResp{DidDelete: deleted})
+}
+
+// deleteUser deletes the user with the given ID if pwd is their password.
+// The user's sessions are revoked, so every cookie issued to them stops
+// working. The lists that the user owns are deleted along with their todos,
+// even if they are shared with other users, whose event streams are notified,
+// and the user is removed from the lists that others have shared with them.
+// The throttled failures recorded for the username are forgotten. deleted is
+// false if the password is incorrect, or if there have been too many failed
+// attempts, in which case wait is how long the client must wait (see
+// checkPassword). If an error occurs, deleteUser logs the error and sets ok
+// to false.
+func (h *apiHandler) deleteUser(ctx context.Context, uid string, pwd string) (deleted bool, wait time.Duration, ok bool) {
+	// Verify the password before starting the transaction, since hashing is
+	// deliberately slow.
+	stored, wait, match, ok := h.checkPassword(ctx, uid, pwd)
+	if !match || !ok {
+		return false, wait, ok
+	}
+
+	ok = h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		query := "SELECT list_id FROM list_members WHERE user_id = $1 AND role = $2"
+		rows, err := tx.Query(ctx, query, uid, roleOwner)
+		if err != nil {
+			log.Printf("Failed to get lists owned by UID %v: %v", uid, err)
+			return false
+		}
+		owned, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			log.Printf("Failed to iterate over query result while getting lists "+
+				"owned by UID %v: %v", uid, err)
+			return false
+		}
+		for _, cmd := range []string{
+			"DELETE FROM todo_changes WHERE list_id = ANY($1)",
+			"DELETE FROM todos WHERE list_id = ANY($1)",
+			"DELETE FROM list_members WHERE list_id = ANY($1)",
+			"DELETE FROM lists WHERE id = ANY($1)",
+		} {
+			if _, err := tx.Exec(ctx, cmd, owned); err != nil {
+				log.Printf("Failed to delete lists owned by UID %v: %v", uid, err)
+				return false
+			}
+		}
+		for _, listID := range owned {
+			if !notifyChange(ctx, tx, listID, 0) {
+				return false
+			}
+		}
+		for _, cmd := range []string{
+			"DELETE FROM list_members WHERE user_id = $1",
+			"DELETE FROM sessions WHERE user_id = $1",
+			"DELETE FROM password_resets WHERE user_id = $1",
+		} {
+			if _, err := tx.Exec(ctx, cmd, uid); err != nil {
+				log.Printf("Failed to delete data for UID %v: %v", uid, err)
+				return false
+			}
+		}
+		// The password is checked again in case it changed after it was
+		// verified.
+		cmd := "DELETE FROM users WHERE id = $1 AND password = $2 RETURNING name"
+		var username string
+		err = tx.QueryRow(ctx, cmd, uid, stored).Scan(&username)
+		if err == pgx.ErrNoRows {
+			return true
+		}
+		if err != nil {
+			log.Printf("Failed to delete user with UID %v: %v", uid, err)
+			return false
+		}
+		if !h.throttles.userDeleted(ctx, tx, username) {
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		deleted = true
+		return true
+	})
+	return deleted, 0, ok
+}
+
+// checkPassword checks whether pwd is the password of the user with the given
+// ID, and returns the stored password hash. Checks are throttled like logins
+// to the user's account, so that a stolen session can't be used to guess the
+// password: if there have been too many failed attempts, the password isn't
+// checked, and wait is how long the client must wait before trying again.
+// match is false if the user doesn't exist. If an error occurs, checkPassword
+// logs the error and sets ok to false.
+func (h *apiHandler) checkPassword(ctx context.Context, uid string, pwd string) (stored string, wait time.Duration, match bool, ok bool) {
+	var username string
+	query := "SELECT name, password FROM users WHERE id = $1"
+	err := h.pool.QueryRow(ctx, query, uid).Scan(&username, &stored)
+	if err == pgx.ErrNoRows {
+		// The user was deleted by another request.
+		return "", 0, false, true
+	}
+	if err != nil {
+		log.Printf("Failed to get password for UID %v: %v", uid, err)
+		return "", 0, false, false
+	}
+	wait, ok = h.throttles.passwordAttempt(ctx, username)
+	if wait > 0 || !ok {
+		return "", wait, false, ok
+	}
+	match, _ = h.pwdHasher.verify(pwd, stored)
+	if match {
+		h.throttles.passwordMatched(ctx, username)
+	}
+	return stored, 0, match, true
+}
+
+// setPassword replaces the stored password hash of the user with the given ID
+// with newHash, and revokes the user's sessions and password reset tokens.
+// If old isn't "", the password is only replaced if the stored hash is still
+// old, and changed is false otherwise. If an error occurs, setPassword logs
+// the error and sets ok to false.
+func setPassword(ctx context.Context, tx pgx.Tx, uid string, old string, newHash string) (changed bool, ok bool) {
+	cmd := "UPDATE users SET password = $1 WHERE id = $2 AND ($3 = '' OR password = $3)"
+	ct, err := tx.Exec(ctx, cmd, newHash, uid, old)
+	if err != nil {
+		log.Printf("Failed to set password for UID %v: %v", uid, err)
+		return false, false
+	}
+	if ct.RowsAffected() != 1 {
+		return false, true
+	}
+	if !revokeAllSessions(ctx, tx, uid) {
+		return false, false
+	}
+	cmd = "DELETE FROM password_resets WHERE user_id = $1"
+	if _, err := tx.Exec(ctx, cmd, uid); err != nil {
+		log.Printf("Failed to delete password reset tokens for UID %v: %v", uid, err)
+		return false, false
+	}
+	return true, true
+}
+
+func (h *apiHandler) serveChangePassword(ctx context.Context, w http.ResponseWriter, r *changePasswordRqst, uid string) {
+	cookie, wait, ok := h.changePassword(ctx, uid, r)
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if cookie == nil {
+		writeJSON(w, &changePasswordResp{DidChange: false})
+		return
+	}
+	http.SetCookie(w, cookie)
+	writeJSON(w, &changePasswordResp{DidChange: true})
+}
+
+// changePassword sets the password of the user with the given ID if the
+// request's current password is correct. Every session of the user is
+// revoked, and a new session is started for the client that changed the
+// password, whose cookie is returned. cookie is nil if the current password
+// is incorrect, or if there have been too many failed attempts, in which case
+// wait is how long the client must wait (see checkPassword). If an error
+// occurs, changePassword logs the error and sets ok to false.
+func (h *apiHandler) changePassword(ctx context.Context, uid string, r *changePasswordRqst) (cookie *http.Cookie, wait time.Duration, ok bool) {
+	stored, wait, match, ok := h.checkPassword(ctx, uid, r.CurrentPassword)
+	if !match || !ok {
+		return nil, wait, ok
+	}
+	newHash, err := h.pwdHasher.hash(r.NewPassword)
+	if err != nil {
+		log.Printf("Failed to hash password: %v", err)
+		return nil, 0, false
+	}
+	ok = h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		// The stored hash is checked again in case the password changed after
+		// it was verified.
+		changed, ok := setPassword(ctx, tx, uid, stored, newHash)
+		if !changed || !ok {
+			return ok
+		}
+		c := h.createCookie(ctx, tx, uid)
+		if c == nil {
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		cookie = c
+		return true
+	})
+	return cookie, 0, ok
+}
+
+// A user who has forgotten their password can request a password reset
+// token, which is delivered to them by h.notifier. The token can be redeemed
+// once, within h.resetTokenLifetime, to set a new password. Only a hash of
+// each token is stored, and requesting a new token invalidates the user's
+// previous ones. If h.notifier is nil, tokens can't be delivered, so they
+// can't be requested.
+
+func (h *apiHandler) serveRequestPasswordReset(ctx context.Context, w http.ResponseWriter, r *requestPasswordResetRqst, ip string) {
+	if !h.checkPasswordResetEnabled(w) {
+		return
+	}
+	wait, ok := h.throttles.passwordResetWait(ctx, ip, r.Username)
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if !h.requestPasswordReset(ctx, r.Username) {
+		writeServerError(ctx, w)
+	}
+}
+
+// checkPasswordResetEnabled returns whether password reset tokens can be
+// delivered. If not, it sends a 503 response.
+func (h *apiHandler) checkPasswordResetEnabled(w http.ResponseWriter) bool {
+	if h.notifier == nil {
+		writeError(w, http.StatusServiceUnavailable, "passwordResetDisabled", "password reset is not available")
+		return false
+	}
+	return true
+}
+
+// requestPasswordReset creates a password reset token for the user with the
+// given username and sends it to them. Nothing happens if the user doesn't
+// exist, and the caller isn't told, so that the request can't be used to
+// discover usernames. If an error occurs, requestPasswordReset logs the error
+// and returns false.
+func (h *apiHandler) requestPasswordReset(ctx context.Context, username string) bool {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate password reset token: %v", err)
+		return false
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	var uid string
+	ok := h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		query := "SELECT id FROM users WHERE name = $1"
+		err := tx.QueryRow(ctx, query, username).Scan(&uid)
+		if err == pgx.ErrNoRows {
+			uid = ""
+			return true
+		}
+		if err != nil {
+			log.Printf("Failed to get UID for name \"%v\": %v", username, err)
+			return false
+		}
+		cmd := "DELETE FROM password_resets WHERE user_id = $1"
+		if _, err := tx.Exec(ctx, cmd, uid); err != nil {
+			log.Printf("Failed to delete password reset tokens for UID %v: %v", uid, err)
+			return false
+		}
+		cmd = "INSERT INTO password_resets (token_hash, user_id, expires) VALUES ($1, $2, $3)"
+		expires := time.Now().Add(h.resetTokenLifetime)
+		if _, err := tx.Exec(ctx, cmd, hashResetToken(token), uid, expires); err != nil {
+			log.Printf("Failed to create password reset token for UID %v: %v", uid, err)
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		return true
+	})
+	if !ok {
+		return false
+	}
+	if uid == "" {
+		return true
+	}
+	if err := h.notifier.notifyPasswordReset(username, token); err != nil {
+		log.Printf("Failed to send password reset token to UID %v: %v", uid, err)
+		return false
+	}
+	return true
+}
+
+func (h *apiHandler) serveResetPassword(ctx context.Context, w http.ResponseWriter, r *resetPasswordRqst, ip string) {
+	if !h.checkPasswordResetEnabled(w) {
+		return
+	}
+	reset, wait, ok := h.resetPassword(ctx, r.Token, r.NewPassword, ip)
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	writeJSON(w, &resetPasswordResp{DidReset: reset})
+}
+
+// resetPassword redeems the given password reset token by setting the
+// password of the user that it belongs to, and revoking the user's sessions.
+// The user must log in again with the new password. reset is false if the
+// token is invalid, has expired, or was already used. Invalid tokens sent
+// from the given IP address are throttled, and if there have been too many,
+// the token isn't checked, and wait is how long the client must wait before
+// trying again (see loginThrottles). If an error occurs, resetPassword logs
+// the error and sets ok to false.
+func (h *apiHandler) resetPassword(ctx context.Context, token string, pwd string, ip string) (reset bool, wait time.Duration, ok bool) {
+	wait, ok = h.throttles.resetTokenAttempt(ctx, ip)
+	if wait > 0 || !ok {
+		return false, wait, ok
+	}
+	// The password is only hashed once the token turns out to be valid, since
+	// hashing is deliberately slow, and anyone can send tokens.
+	var newHash string
+	ok = h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		reset = false
+		// Deleting the token makes sure that it can only be used once.
+		var uid string
+		var expires time.Time
+		cmd := "DELETE FROM password_resets WHERE token_hash = $1 RETURNING user_id, expires"
+		err := tx.QueryRow(ctx, cmd, hashResetToken(token)).Scan(&uid, &expires)
+		if err == pgx.ErrNoRows {
+			return true
+		}
+		if err != nil {
+			log.Printf("Failed to redeem password reset token: %v", err)
+			return false
+		}
+		if time.Now().Before(expires) {
+			if newHash == "" {
+				newHash, err = h.pwdHasher.hash(pwd)
+				if err != nil {
+					log.Printf("Failed to hash password: %v", err)
+					return false
+				}
+			}
+			var ok bool
+			reset, ok = setPassword(ctx, tx, uid, "", newHash)
+			if !ok {
+				return false
+			}
+		}
+		// Commit even if the token has expired, so that it is cleaned up.
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		return true
+	})
+	reset = reset && ok
+	if reset {
+		h.throttles.resetTokenRedeemed(ctx, ip)
+	}
+	return reset, 0, ok
+}
+
+// hashResetToken returns the hash of a password reset token that is stored
+// in the database. Tokens are random, so a fast hash suffices.
+func hashResetToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
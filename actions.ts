@@ -19,6 +19,7 @@ export type CreateUserArgs = {
   password: string;
   onLoggedIn: () => void;
   onUsernameTaken: () => void;
+  onFieldRejected: (field: string, message: string) => void;
 };
 
 export type RawTodos = [string, string][];
@@ -28,6 +29,43 @@ export type TodosSnapshot = {
   todos: RawTodos;
 };
 
+export type TodoChange = {
+  id: string;
+  value: string;
+  deleted: boolean;
+};
+
+/**
+ * TodosDelta holds the todos that changed since the client's version. See
+ * versionMismatchDeltaResp in messages.go.
+ */
+export type TodosDelta = {
+  version: number;
+  changes: TodoChange[];
+};
+
+/**
+ * ListVersion is the data of a "version" event. See versionEvent in events.go.
+ */
+export type ListVersion = {
+  listId: string;
+  version: number;
+};
+
+/**
+ * ListChanges is the data of a "changes" event, which holds the todos that
+ * changed after version `since`. See changesEvent in events.go.
+ */
+export type ListChanges = TodosDelta & {
+  listId: string;
+  since: number;
+};
+
+export type SubscribeToChangesArgs = {
+  onVersionReceived: (result: ListVersion) => void;
+  onChangesReceived: (result: ListChanges) => void;
+};
+
 export type GetTodosArgs = {
   onTodosReceived: (result: TodosSnapshot) => void;
 };
@@ -35,12 +73,14 @@ export type GetTodosArgs = {
 export type RefreshTodosArgs = {
   version: number;
   onTodosReceived: (result: TodosSnapshot) => void;
+  onChangesReceived: (result: TodosDelta) => void;
 };
 
 export type DeleteTodoArgs = {
   version: number;
   id: string;
   onTodosReceived: (result: TodosSnapshot) => void;
+  onChangesReceived: (result: TodosDelta) => void;
   onResultReceived: (result: { version: number }) => void
 };
 
@@ -48,6 +88,7 @@ export type AppendNewTodoArgs = {
   version: number;
   id: string;
   onTodosReceived: (result: TodosSnapshot) => void;
+  onChangesReceived: (result: TodosDelta) => void;
   onResultReceived: (result: { version: number }) => void
 };
 
@@ -56,6 +97,7 @@ export type UpdateTodoArgs = {
   id: string;
   value: string;
   onTodosReceived: (result: TodosSnapshot) => void;
+  onChangesReceived: (result: TodosDelta) => void;
   onResultReceived: (result: { version: number }) => void
 };
 
@@ -105,7 +147,21 @@ export function createActions(apiUrl: string) {
 
   async function register(args: CreateUserArgs) {
     const { username, password } = args;
-    const resp = await callApi({ operation: "createUser", username, password });
+    const resp = await fetch(apiUrl, {
+      method: "POST",
+      body: JSON.stringify({ operation: "createUser", username, password }),
+    });
+    if (resp.status === 400) {
+      // The username or password was rejected by the server's validation.
+      const { code, message, field } = await parseJson(resp);
+      if (code === "invalidField" && field !== undefined) {
+        args.onFieldRejected(field, message);
+        return;
+      }
+    }
+    if (resp.status !== 200) {
+      throw new Error(`Received a non-200 status code: ${resp.status}`);
+    }
     const { isNameTaken } = await parseJson(resp);
     if (isNameTaken) {
       args.onUsernameTaken();
@@ -124,35 +180,45 @@ export function createActions(apiUrl: string) {
 
   async function refreshTodos(args: RefreshTodosArgs) {
     const resp = await callApi(
-      { operation: "refreshTodos", version: args.version },
+      { operation: "refreshTodos", version: args.version, delta: true },
     );
     if (!containsJson(resp)) {
       console.log("refreshTodos: Already up-to-date.");
       return;
     }
     const result = await parseJson(resp);
+    if (result.changes !== undefined) {
+      args.onChangesReceived(result);
+      return;
+    }
     args.onTodosReceived(result);
   }
 
   async function deleteTodo(args: DeleteTodoArgs) {
     const resp = await callApi(
-      { operation: "deleteTodo", version: args.version, id: args.id }
+      { operation: "deleteTodo", version: args.version, id: args.id, delta: true }
     );
     const result = await parseJson(resp);
     if (result.todos !== undefined) {
       args.onTodosReceived(result);
     }
+    if (result.changes !== undefined) {
+      args.onChangesReceived(result);
+    }
     args.onResultReceived(result);
   }
 
   async function appendNewTodo(args: AppendNewTodoArgs) {
     const resp = await callApi(
-      { operation: "appendTodo", version: args.version, id: args.id }
+      { operation: "appendTodo", version: args.version, id: args.id, delta: true }
     );
     const result = await parseJson(resp);
     if (result.todos !== undefined) {
       args.onTodosReceived(result);
     }
+    if (result.changes !== undefined) {
+      args.onChangesReceived(result);
+    }
     args.onResultReceived(result);
   }
 
@@ -161,15 +227,44 @@ export function createActions(apiUrl: string) {
       operation: "updateTodo",
       version: args.version,
       id: args.id,
-      value: args.value
+      value: args.value,
+      delta: true
     });
     const result = await parseJson(resp);
     if (result.todos !== undefined) {
       args.onTodosReceived(result);
     }
+    if (result.changes !== undefined) {
+      args.onChangesReceived(result);
+    }
     args.onResultReceived(result);
   }
 
+  /**
+   * subscribeToChanges opens a stream of todo list changes, which the server
+   * sends whenever the list changes (including changes made by this client).
+   * Each change arrives as the todos that changed, or, if the server can't
+   * tell which todos changed, just the new version. The browser reconnects
+   * automatically if the stream is interrupted. The stream is closed if the
+   * server reports that the list was removed.
+   *
+   * subscribeToChanges returns a function that closes the stream.
+   */
+  function subscribeToChanges(args: SubscribeToChangesArgs) {
+    const source = new EventSource(`${apiUrl}/events`);
+    source.addEventListener("version", (e) => {
+      args.onVersionReceived(JSON.parse(e.data));
+    });
+    source.addEventListener("changes", (e) => {
+      args.onChangesReceived(JSON.parse(e.data));
+    });
+    source.addEventListener("removed", () => {
+      console.log("subscribeToChanges: The list was removed.");
+      source.close();
+    });
+    return () => source.close();
+  }
+
   /**
    * callApi initiates a POST request to apiUrl and returns the {@link Response}.
    * The request body is the JSON encoding of msg.
@@ -197,7 +292,8 @@ export function createActions(apiUrl: string) {
     refreshTodos,
     deleteTodo,
     appendNewTodo,
-    updateTodo
+    updateTodo,
+    subscribeToChanges
   };
 }
 
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (h *apiHandler) serveBatch(ctx context.Context, w http.ResponseWriter, r *batchRqst, uid string) {
+	writeResult(ctx, w, h.txBatch(ctx, r, uid))
+}
+
+// txBatch runs a transaction that applies every operation in the given batch
+// request, in order, and increments the todo list version once. Either every
+// operation is applied or none are.
+//
+// As with txMutateTodo, a batch based on a stale version is still applied as
+// long as none of its updates or deletes conflict with someone else's change.
+// Otherwise, the whole batch is rejected, and the mismatch response describes
+// the first conflict.
+//
+// txBatch returns a response struct if the transaction was successful, an
+// *errorResp if the transaction failed due to a problem with the request, or
+// nil if the transaction failed for some other reason.
+func (h *apiHandler) txBatch(ctx context.Context, r *batchRqst, uid string) (result any) {
+	ops := make([]execOperation, len(r.Ops))
+	for i, o := range r.Ops {
+		ops[i] = o.execOperation()
+	}
+	h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		listID, e, ok := resolveList(ctx, tx, uid, r.ListID, roleEditor)
+		if !ok {
+			return false
+		}
+		if e != nil {
+			result = e
+			return true
+		}
+		storedVersion, ok := getVersion(ctx, tx, listID)
+		if !ok {
+			return false
+		}
+		if r.Version != storedVersion {
+			conflict, ok := checkBatchConflicts(ctx, tx, r, storedVersion, ops, listID)
+			if !ok {
+				return false
+			}
+			if conflict != nil {
+				resp, ok := versionMismatch(ctx, tx, listID, r.Version, storedVersion, r.syncOptions,
+					mismatchDetails{Conflict: conflict})
+				if !ok {
+					return false
+				}
+				if err := tx.Commit(ctx); err != nil {
+					log.Printf("Failed to commit transaction: %v", err)
+					return false
+				}
+				versionMismatches.inc("conflict")
+				result = resp
+				return true
+			}
+		}
+		appends := 0
+		for _, o := range r.Ops {
+			if o.Op == "append" {
+				appends++
+			}
+		}
+		if e, ok := checkListSize(ctx, tx, listID, appends); e != nil || !ok {
+			result = e
+			return ok
+		}
+		newVersion := nextVersion(storedVersion)
+		for i, op := range ops {
+			id := r.Ops[i].ID
+			switch mutateTodo(ctx, tx, op, newVersion, id, listID) {
+			case "success":
+			case "nonexistent":
+				result = &errorResp{
+					Code:    "todoNotFound",
+					Message: fmt.Sprintf("ops[%d]: the todo does not exist", i),
+				}
+				return true
+			case "exists":
+				result = &errorResp{
+					Code:    "todoExists",
+					Message: fmt.Sprintf("ops[%d]: a todo with the given ID already exists", i),
+				}
+				return true
+			default:
+				return false
+			}
+			if !logChange(ctx, tx, listID, newVersion, id, false) {
+				return false
+			}
+		}
+		if _, ok := incrementVersion(ctx, tx, storedVersion, listID); !ok {
+			return false
+		}
+		var resp any = &batchResp{Version: newVersion}
+		if r.Version != storedVersion {
+			resp, ok = versionMismatch(ctx, tx, listID, r.Version, newVersion, r.syncOptions,
+				mismatchDetails{Merged: true})
+			if !ok {
+				return false
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		if r.Version != storedVersion {
+			versionMismatches.inc("merged")
+		}
+		result = resp
+		return true
+	})
+	return result
+}
+
+// checkBatchConflicts checks each operation in the batch for a conflict with
+// someone else's change, and returns the first conflict found, or nil if there
+// are none. Operations on todos that were appended earlier in the batch can't
+// conflict. If an error occurs, checkBatchConflicts logs the error and sets ok
+// to false.
+func checkBatchConflicts(ctx context.Context, tx pgx.Tx, r *batchRqst, storedVersion int32, ops []execOperation, listID string) (conflict *todoConflict, ok bool) {
+	appended := map[string]bool{}
+	for i, op := range ops {
+		id := r.Ops[i].ID
+		if op.conflict() == nil {
+			appended[id] = true
+			continue
+		}
+		if appended[id] {
+			continue
+		}
+		conflict, ok := checkConflict(ctx, tx, r.Version, storedVersion, id, listID, op)
+		if !ok || conflict != nil {
+			return conflict, ok
+		}
+	}
+	return nil, true
+}
+
+// execOperation returns the execOperation that carries out o.
+func (o *batchOp) execOperation() execOperation {
+	switch o.Op {
+	case "append":
+		return &appendOperation{id: o.ID}
+	case "update":
+		return &updateOperation{id: o.ID, value: *o.Value, attrs: o.todoAttrUpdate}
+	default:
+		return &deleteOperation{id: o.ID}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatchValidate(t *testing.T) {
+	const id = "6f1c7d4e-3b1a-4a51-9a53-0e4c2f6d8b21"
+	tests := []struct {
+		name  string
+		body  string
+		field string // the field of the expected error, or "" if valid
+	}{
+		{
+			name: "update with value",
+			body: `{"version":1,"ops":[{"op":"update","id":"` + id + `","value":"milk"}]}`,
+		},
+		{
+			name: "update with value and attributes",
+			body: `{"version":1,"ops":[{"op":"update","id":"` + id + `","value":"milk","completed":true}]}`,
+		},
+		{
+			name: "update with empty value",
+			body: `{"version":1,"ops":[{"op":"update","id":"` + id + `","value":""}]}`,
+		},
+		{
+			// Without a value, the update would clear the todo's text.
+			name:  "attribute-only update",
+			body:  `{"version":1,"ops":[{"op":"update","id":"` + id + `","completed":true}]}`,
+			field: "value",
+		},
+		{
+			name:  "update with null value",
+			body:  `{"version":1,"ops":[{"op":"update","id":"` + id + `","value":null,"priority":2}]}`,
+			field: "value",
+		},
+		{
+			name: "append and delete without value",
+			body: `{"version":1,"ops":[{"op":"append","id":"` + id + `"},{"op":"delete","id":"` + id + `"}]}`,
+		},
+		{
+			name:  "no ops",
+			body:  `{"version":1,"ops":[]}`,
+			field: "ops",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := decodeRqst([]byte(tt.body), &batchRqst{})
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("got error %v, want none", err)
+				}
+				return
+			}
+			var fe *fieldError
+			if !errors.As(err, &fe) {
+				t.Fatalf("got error %v, want a fieldError", err)
+			}
+			if fe.field != tt.field {
+				t.Errorf("got error for field %q, want %q", fe.field, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Each time a todo list version is incremented, the IDs of the todos that
+// changed are recorded in the todo_changes table under the new version. This
+// allows a client with a stale version to be sent only the todos that changed
+// since its version, rather than a full snapshot of the list. Only the last
+// changeLogLength versions of each list are kept; clients with older versions
+// are sent a full snapshot. Changes that reorder the list are flagged, and
+// clients whose versions predate such a change are also sent a full snapshot,
+// since a delta doesn't convey the order of unchanged todos.
+
+// changeLogLength is the number of versions kept in each list's change log.
+const changeLogLength = 1000
+
+// logChange records that the todo with the given ID changed in the given
+// version of the list, and discards entries that are too old to keep.
+// reordered indicates that the change moved the todo within the list.
+// If an error occurs, logChange logs the error and returns false.
+func logChange(ctx context.Context, tx pgx.Tx, listID string, version int32, id string, reordered bool) bool {
+	cmd := "INSERT INTO todo_changes (list_id, version, todo_id, reordered) VALUES ($1, $2, $3, $4)"
+	if _, err := tx.Exec(ctx, cmd, listID, version, id, reordered); err != nil {
+		log.Printf("Failed to log change to todo with ID %v and list ID %v: %v", id, listID, err)
+		return false
+	}
+	// Entries with versions greater than the current version were logged
+	// before the version wrapped around to 0.
+	cmd = "DELETE FROM todo_changes WHERE list_id = $1 AND (version <= $2 OR version > $3)"
+	_, err := tx.Exec(ctx, cmd, listID, version-changeLogLength, version)
+	if err != nil {
+		log.Printf("Failed to compact change log for list ID %v: %v", listID, err)
+		return false
+	}
+	return true
+}
+
+// versionMismatches is incremented by the callers of versionMismatch once
+// their transaction commits, so that retried transactions are counted once.
+var versionMismatches = newCounterVec("todo_version_mismatches_total",
+	"Responses to requests based on a stale list version, by outcome (\"merged\", \"conflict\" or \"stale\").", "outcome")
+
+// versionMismatch returns the response for a client whose version of the
+// list with the given ID, clientVersion, doesn't match the stored version. If
+// opts.Delta is true and the change log reaches back to clientVersion,
+// versionMismatch returns a versionMismatchDeltaResp; otherwise it returns a
+// versionMismatchResp in the format requested by opts.Structured. Either way,
+// the response includes the given details. If an error occurs,
+// versionMismatch logs the error and sets ok to false.
+func versionMismatch(ctx context.Context, tx pgx.Tx, listID string, clientVersion int32, storedVersion int32, opts syncOptions, details mismatchDetails) (resp any, ok bool) {
+	if opts.Delta && clientVersion < storedVersion {
+		changes, covered, ok := getChanges(ctx, tx, listID, clientVersion)
+		if !ok {
+			return nil, false
+		}
+		if covered {
+			return &versionMismatchDeltaResp{
+				Version:         storedVersion,
+				Changes:         changes,
+				mismatchDetails: details,
+			}, true
+		}
+	}
+	todos := getTodos(ctx, tx, listID)
+	if todos == nil {
+		return nil, false
+	}
+	return &versionMismatchResp{
+		Version:         storedVersion,
+		Todos:           todoList{todos: todos, structured: opts.Structured},
+		mismatchDetails: details,
+	}, true
+}
+
+// getChanges gets the current state of every todo that changed after the
+// given version of the list, in list order with deleted todos first.
+// covered is false if the change log doesn't reach back to the given version,
+// or if the list was reordered since then, in which case changes is nil. If
+// an error occurs, getChanges logs the error and sets ok to false.
+func getChanges(ctx context.Context, tx pgx.Tx, listID string, since int32) (changes []todoChange, covered bool, ok bool) {
+	var oldest *int32
+	var reordered bool
+	query := `
+		SELECT min(version), coalesce(bool_or(reordered) FILTER (WHERE version > $2), false)
+		FROM todo_changes WHERE list_id = $1`
+	err := tx.QueryRow(ctx, query, listID, since).Scan(&oldest, &reordered)
+	if err != nil {
+		log.Printf("Failed to get oldest change for list ID \"%v\": %v", listID, err)
+		return nil, false, false
+	}
+	if oldest == nil || *oldest > since+1 || reordered {
+		return nil, false, true
+	}
+	query = `
+		SELECT c.todo_id, t.value, t.completed_at, t.due_at, t.priority
+		FROM (
+			SELECT DISTINCT todo_id FROM todo_changes
+			WHERE list_id = $1 AND version > $2
+		) c
+		LEFT JOIN todos t ON t.id = c.todo_id AND t.list_id = $1
+		ORDER BY t.position NULLS FIRST`
+	rows, err := tx.Query(ctx, query, listID, since)
+	if err != nil {
+		log.Printf("Failed to get changes for list ID \"%v\": %v", listID, err)
+		return nil, false, false
+	}
+	defer rows.Close()
+	changes, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (todoChange, error) {
+		var c todoChange
+		var value *string
+		var priority *int32
+		err := row.Scan(&c.ID, &value, &c.CompletedAt, &c.DueAt, &priority)
+		if value == nil {
+			c.Deleted = true
+		} else {
+			c.Value = *value
+			c.Completed = c.CompletedAt != nil
+			c.Priority = *priority
+		}
+		return c, err
+	})
+	if err != nil {
+		log.Printf("Failed to iterate over query result while getting changes "+
+			"for list ID \"%v\": %v", listID, err)
+		return nil, false, false
+	}
+	return changes, true, true
+}
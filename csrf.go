@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The access token cookie is sent with every request to the server, so a
+// malicious site could make a user's browser send requests on their behalf
+// (cross-site request forgery). SameSite=Strict stops browsers from attaching
+// the cookie to such requests, and, as a second line of defense, requests that
+// change state are rejected unless the browser says that they came from the
+// application's own origin, or from one of the trusted origins.
+//
+// Browsers mark every request with the Sec-Fetch-Site header, or, if they are
+// too old to support it, send an Origin header with every POST request.
+// Requests with neither header don't come from a browser, so they can't be
+// forged this way, and are allowed.
+
+// originChecker checks that requests come from an allowed origin.
+type originChecker struct {
+	// trusted contains the origins (e.g. "https://example.com") that are
+	// allowed in addition to the server's own.
+	trusted map[string]bool
+}
+
+// newOriginChecker returns an originChecker that trusts the comma-separated
+// origins in TRUSTED_ORIGINS.
+func newOriginChecker() *originChecker {
+	c := &originChecker{trusted: map[string]bool{}}
+	for _, o := range strings.Split(os.Getenv("TRUSTED_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			c.trusted[strings.TrimSuffix(o, "/")] = true
+		}
+	}
+	return c
+}
+
+// allowed returns whether the given request comes from the server's own
+// origin or a trusted origin, or doesn't come from a browser.
+func (c *originChecker) allowed(r *http.Request) bool {
+	site := r.Header.Get("Sec-Fetch-Site")
+	if site == "same-origin" || site == "none" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return site == ""
+	}
+	if c.trusted[origin] {
+		return true
+	}
+	if site != "" {
+		// The request came from another site.
+		return false
+	}
+	// Only the Origin header was sent. Behind a proxy that rewrites the Host
+	// header, the server's own origin must be listed in TRUSTED_ORIGINS.
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// checkOrigin checks that the given request comes from an allowed origin. If
+// not, checkOrigin writes http.StatusForbidden and returns false.
+func (h *apiHandler) checkOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if h.origins.allowed(r) {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "crossOriginRequest", "requests from other sites are not allowed")
+	return false
+}
+
+// cookieAttrs are the attributes of the access token cookie that depend on
+// how the application is deployed.
+type cookieAttrs struct {
+	// secure restricts the cookie to HTTPS connections.
+	secure bool
+	domain string
+	path   string
+}
+
+// newCookieAttrs returns the attributes set by COOKIE_SECURE (default true),
+// COOKIE_DOMAIN (default unset, which restricts the cookie to the server's
+// host), and COOKIE_PATH (default "/").
+func newCookieAttrs() cookieAttrs {
+	path, ok := os.LookupEnv("COOKIE_PATH")
+	if !ok {
+		path = "/"
+	}
+	return cookieAttrs{
+		secure: lookupEnvBool("COOKIE_SECURE", true),
+		domain: os.Getenv("COOKIE_DOMAIN"),
+		path:   path,
+	}
+}
+
+// newCookie returns the access token cookie with the given value.
+func (h *apiHandler) newCookie(value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     h.cookieName,
+		Value:    value,
+		Domain:   h.cookieAttrs.domain,
+		Path:     h.cookieAttrs.path,
+		Secure:   h.cookieAttrs.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginCheckerAllowed(t *testing.T) {
+	t.Setenv("TRUSTED_ORIGINS", "https://trusted.example, https://app.example/")
+	c := newOriginChecker()
+	tests := []struct {
+		name         string
+		site, origin string
+		host         string
+		allowed      bool
+	}{
+		{"no headers", "", "", "todo.example", true},
+		{"same origin", "same-origin", "https://todo.example", "todo.example", true},
+		{"user initiated", "none", "", "todo.example", true},
+		{"same site", "same-site", "https://evil.todo.example", "todo.example", false},
+		{"cross site", "cross-site", "https://evil.example", "todo.example", false},
+		{"cross site without Origin", "cross-site", "", "todo.example", false},
+		{"cross site, trusted", "cross-site", "https://trusted.example", "todo.example", true},
+		{"trusted with trailing slash", "cross-site", "https://app.example", "todo.example", true},
+		{"cross site, own host", "cross-site", "https://todo.example", "todo.example", false},
+		// Browsers that don't send Sec-Fetch-Site.
+		{"Origin only, own host", "", "https://todo.example", "todo.example", true},
+		{"Origin only, other host", "", "https://evil.example", "todo.example", false},
+		{"Origin only, trusted", "", "https://trusted.example", "todo.example", true},
+		{"Origin only, null", "", "null", "todo.example", false},
+		{"Origin only, other port", "", "https://todo.example:8443", "todo.example", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api", nil)
+		r.Host = tt.host
+		if tt.site != "" {
+			r.Header.Set("Sec-Fetch-Site", tt.site)
+		}
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := c.allowed(r); got != tt.allowed {
+			t.Errorf("%v: allowed = %v, want %v", tt.name, got, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Changes to a todo list are pushed to the open sessions that display it as
+// Server-Sent Events. Whenever a transaction increments a list version,
+// deletes a list, or removes a member from a list, it also sends a PostgreSQL
+// notification on changesChannel. Every server instance LISTENs on that
+// channel and forwards each notification to the matching subscribers, so a
+// change made through one instance reaches clients connected to any other
+// instance. The events carry the todos that changed since the previous event,
+// read from the change log (see getChanges), so clients needn't fetch them.
+// If the change log doesn't cover the change, e.g. because the list was
+// reordered, the event only carries the new version, and clients fetch the
+// todos themselves.
+
+// changesChannel is the PostgreSQL notification channel for version changes.
+const changesChannel = "todo_changes"
+
+// changeNotification is the payload of a notification on changesChannel.
+// Version is 0 if the list was deleted or a member was removed.
+type changeNotification struct {
+	ListID  string `json:"listId"`
+	Version int32  `json:"version"`
+}
+
+// notifyChange sends a notification that the todo list with the given ID
+// changed to the given version, or, if version is 0, that the list was deleted
+// or a member was removed. The notification is delivered when tx commits, and
+// discarded if tx is rolled back. If an error occurs, notifyChange logs the
+// error and returns false.
+func notifyChange(ctx context.Context, tx pgx.Tx, listID string, version int32) bool {
+	payload, err := json.Marshal(&changeNotification{ListID: listID, Version: version})
+	if err != nil {
+		log.Printf("Failed to encode change notification: %v", err)
+		return false
+	}
+	_, err = tx.Exec(ctx, "SELECT pg_notify($1, $2)", changesChannel, string(payload))
+	if err != nil {
+		log.Printf("Failed to notify change for list ID %v: %v", listID, err)
+		return false
+	}
+	return true
+}
+
+// changeHub fans out change notifications to the subscribers on this
+// instance.
+type changeHub struct {
+	mu sync.Mutex
+	// subs maps each list ID to the set of channels subscribed to that list's
+	// changes.
+	subs map[string]map[chan struct{}]bool
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{subs: map[string]map[chan struct{}]bool{}}
+}
+
+// subscribe returns a channel that receives a value whenever the todo list
+// with the given ID changes, and a function that cancels the subscription.
+// Notifications are coalesced: if the subscriber hasn't received the previous
+// value yet, no new value is sent.
+func (c *changeHub) subscribe(listID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[listID] == nil {
+		c.subs[listID] = map[chan struct{}]bool{}
+	}
+	c.subs[listID][ch] = true
+	return ch, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.subs[listID], ch)
+		if len(c.subs[listID]) == 0 {
+			delete(c.subs, listID)
+		}
+	}
+}
+
+// publish signals every subscriber to the given list's changes.
+func (c *changeHub) publish(listID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ch := range c.subs[listID] {
+		wake(ch)
+	}
+}
+
+// publishAll signals every subscriber. It is used after notifications may
+// have been missed.
+func (c *changeHub) publishAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, chs := range c.subs {
+		for ch := range chs {
+			wake(ch)
+		}
+	}
+}
+
+// wake sends a value on ch without blocking.
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// listen receives notifications on changesChannel and publishes them until ctx
+// is canceled. listen holds one of the pool's connections for as long as it
+// runs. If the connection fails, listen reconnects with exponential backoff,
+// which starts over once a connection has been established.
+func (c *changeHub) listen(ctx context.Context, pool *pgxpool.Pool) {
+	const minBackoff = time.Second
+	backoff := minBackoff
+	for {
+		listening, err := c.listenOnce(ctx, pool)
+		if ctx.Err() != nil {
+			return
+		}
+		if listening {
+			backoff = minBackoff
+		}
+		log.Printf("Stopped listening for changes: %v. Retrying in %v.", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// listenOnce acquires a connection, LISTENs on changesChannel, and publishes
+// notifications until an error occurs. listening is true if the LISTEN
+// succeeded. Since notifications may have been missed while the connection
+// was down, every subscriber is signaled once the LISTEN succeeds, so that
+// changes committed before then are noticed too.
+func (c *changeHub) listenOnce(ctx context.Context, pool *pgxpool.Pool) (listening bool, err error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	// A connection that is LISTENing must not be reused by other queries, so
+	// close it rather than returning it to the pool as-is.
+	defer func() {
+		if err := conn.Conn().Close(context.Background()); err != nil {
+			log.Println(err)
+		}
+		conn.Release()
+	}()
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return false, err
+	}
+	c.publishAll()
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		var cn changeNotification
+		if err := json.Unmarshal([]byte(n.Payload), &cn); err != nil {
+			log.Printf("Received invalid change notification %q: %v", n.Payload, err)
+			continue
+		}
+		c.publish(cn.ListID)
+	}
+}
+
+// eventKeepAliveInterval is how often a comment is sent on an otherwise idle
+// event stream, so that proxies don't close the connection.
+const eventKeepAliveInterval = 30 * time.Second
+
+// versionEvent is the data of a "version" event.
+type versionEvent struct {
+	ListID  string `json:"listId"`
+	Version int32  `json:"version"`
+}
+
+// changesEvent is the data of a "changes" event. Changes holds the current
+// state of every todo that changed after version Since, as in a
+// versionMismatchDeltaResp.
+type changesEvent struct {
+	ListID  string       `json:"listId"`
+	Since   int32        `json:"since"`
+	Version int32        `json:"version"`
+	Changes []todoChange `json:"changes"`
+}
+
+// removedEvent is the data of a "removed" event.
+type removedEvent struct {
+	ListID string `json:"listId"`
+}
+
+// serveEvents streams the changes to a todo list as Server-Sent Events. The
+// list is given by the listId query parameter, or is the user's default list
+// if the parameter is omitted. A "version" event, whose data is a
+// versionEvent, is sent when the stream opens. Whenever the list version
+// changes, a "changes" event, whose data is a changesEvent, is sent, or a
+// "version" event if the change log doesn't cover the change. If the list is
+// deleted or the user is removed from it, a "removed" event, whose data is a
+// removedEvent, is sent and the stream ends. The stream has no time limit, but
+// each check for changes is limited by the timeout of getTodos.
+func (h *apiHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	uid := h.verifyCookie(w, r)
+	if uid == "" {
+		return
+	}
+	// The stream outlives the server's write timeout, so the deadline is
+	// cleared, and each write sets its own instead (see writeStream).
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to stream events: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	listID, ok := listParam(w, r)
+	if !ok {
+		return
+	}
+	timeout := h.timeouts.get("getTodos")
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	listID, version, e, ok := h.txGetVersion(ctx, uid, listID)
+	cancel()
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if e != nil {
+		writeError(w, http.StatusBadRequest, e.Code, e.Message)
+		return
+	}
+	changes, unsubscribe := h.changes.subscribe(listID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	lastVersion := version
+	if !writeEvent(rc, w, "version", &versionEvent{ListID: listID, Version: version}) {
+		return
+	}
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	// The list ID isn't known until the version is first read, so the
+	// subscription starts afterwards. Check for a change made in between.
+	check := true
+	for {
+		if check {
+			check = false
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			version, changes, covered, e, ok := h.txGetChanges(ctx, uid, listID, lastVersion)
+			cancel()
+			if !ok {
+				// The client will reconnect and check again.
+				return
+			}
+			if e != nil {
+				writeEvent(rc, w, "removed", &removedEvent{ListID: listID})
+				return
+			}
+			if version != lastVersion {
+				var event any = &versionEvent{ListID: listID, Version: version}
+				name := "version"
+				if covered {
+					event = &changesEvent{ListID: listID, Since: lastVersion, Version: version, Changes: changes}
+					name = "changes"
+				}
+				lastVersion = version
+				if !writeEvent(rc, w, name, event) {
+					return
+				}
+			}
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.shutdown:
+			// The client will reconnect to another instance.
+			return
+		case <-keepAlive.C:
+			if !writeStream(rc, w, ": keep-alive\n\n") {
+				return
+			}
+		case <-changes:
+			check = true
+		}
+	}
+}
+
+// txGetVersion gets the ID and version of the list that listID refers to for
+// the given user (see resolveList). If the user can't read the list, e
+// describes the problem. If an error occurs, txGetVersion logs the error and
+// sets ok to false.
+func (h *apiHandler) txGetVersion(ctx context.Context, uid string, listID string) (id string, version int32, e *errorResp, ok bool) {
+	ok = h.runTx(ctx, pgx.ReadOnly, func(tx pgx.Tx) bool {
+		var ok bool
+		id, e, ok = resolveList(ctx, tx, uid, listID, roleViewer)
+		if !ok || e != nil {
+			return ok
+		}
+		version, ok = getVersion(ctx, tx, id)
+		if !ok {
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		return true
+	})
+	return id, version, e, ok
+}
+
+// txGetChanges gets the version of the list with the given ID, and, if the
+// version isn't since, the todos that changed after since (see getChanges).
+// If the user can no longer read the list, e describes the problem. If an
+// error occurs, txGetChanges logs the error and sets ok to false.
+func (h *apiHandler) txGetChanges(ctx context.Context, uid string, listID string, since int32) (version int32, changes []todoChange, covered bool, e *errorResp, ok bool) {
+	ok = h.runTx(ctx, pgx.ReadOnly, func(tx pgx.Tx) bool {
+		var ok bool
+		_, e, ok = resolveList(ctx, tx, uid, listID, roleViewer)
+		if !ok || e != nil {
+			return ok
+		}
+		version, ok = getVersion(ctx, tx, listID)
+		if !ok {
+			return false
+		}
+		changes, covered = nil, false
+		if version > since {
+			changes, covered, ok = getChanges(ctx, tx, listID, since)
+			if !ok {
+				return false
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		return true
+	})
+	return version, changes, covered, e, ok
+}
+
+// writeEvent writes a Server-Sent Event with the given name, whose data is
+// the JSON encoding of v. writeEvent returns false if the client has gone
+// away or v can't be encoded.
+func writeEvent(rc *http.ResponseController, w http.ResponseWriter, name string, v any) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return writeStream(rc, w, fmt.Sprintf("event: %s\ndata: %s\n\n", name, data))
+}
+
+// eventWriteTimeout is how long a write to an event stream may take before
+// the client is assumed to have gone away.
+const eventWriteTimeout = 10 * time.Second
+
+// writeStream writes s to an event stream and flushes it. writeStream returns
+// false if the client has gone away.
+func writeStream(rc *http.ResponseController, w http.ResponseWriter, s string) bool {
+	if err := rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout)); err != nil {
+		log.Println(err)
+		return false
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		return false
+	}
+	return rc.Flush() == nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The application serves two probes for load balancers and orchestrators:
+// /healthz succeeds as long as the process can serve requests, and /readyz
+// succeeds only if the instance can also serve the API. A failing /readyz
+// means that the instance should receive no new traffic, while a failing
+// /healthz means that it should be restarted.
+
+// readyTimeout is how long the readiness check may take.
+const readyTimeout = 2 * time.Second
+
+// serveHealth reports that the process is up.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	writeText(w, "ok\n")
+}
+
+// readinessHandler reports whether the instance is ready to serve the API.
+type readinessHandler struct {
+	pool *dbPool
+	// schemaVersion is the schema version that the binary expects, i.e. the
+	// number of migrations.
+	schemaVersion int
+	// draining is closed when the server starts shutting down.
+	draining <-chan struct{}
+}
+
+// ServeHTTP responds with 200 if the instance is ready, or 503 if it isn't, in
+// which case the reason is logged. The instance is ready if it isn't shutting
+// down, it can acquire a database connection, and the schema is at least at
+// the expected version. A newer schema is accepted, since migrations are
+// applied before the instances running the previous version are replaced, and
+// those instances must keep serving until then.
+func (h *readinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if reason := h.check(ctx); reason != "" {
+		log.Printf("Not ready: %v", reason)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeText(w, "not ready\n")
+		return
+	}
+	writeText(w, "ok\n")
+}
+
+// writeText writes s to w, and logs any error, as writeJSON does.
+func writeText(w io.Writer, s string) {
+	if _, err := io.WriteString(w, s); err != nil {
+		log.Println(err)
+	}
+}
+
+// check returns why the instance isn't ready, or "" if it is.
+func (h *readinessHandler) check(ctx context.Context) string {
+	select {
+	case <-h.draining:
+		return "shutting down"
+	default:
+	}
+	conn, err := h.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Sprintf("failed to acquire database connection: %v", err)
+	}
+	defer conn.Release()
+	version, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return fmt.Sprintf("failed to get schema version: %v", err)
+	}
+	if version < h.schemaVersion {
+		return fmt.Sprintf("schema version is %v, expected at least %v", version, h.schemaVersion)
+	}
+	return ""
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwtKeySet holds the key used to sign access tokens, along with every key
+// that is accepted when verifying them. Each key is identified by a key ID,
+// which is stored in the "kid" header of the tokens it signs. Keeping previous
+// keys in the set allows the signing key to be rotated without invalidating
+// tokens that were signed with the old key.
+type jwtKeySet struct {
+	// signingKeyID identifies the signing key. It is "" if this instance can
+	// only verify tokens.
+	signingKeyID  string
+	signingMethod jwt.SigningMethod
+	// signingKey is a []byte for HS256 or an ed25519.PrivateKey for EdDSA.
+	signingKey any
+	// verificationKeys maps key IDs to keys, including the signing key.
+	verificationKeys map[string]jwtKey
+}
+
+type jwtKey struct {
+	method jwt.SigningMethod
+	// key is a []byte for HS256 or an ed25519.PublicKey for EdDSA.
+	key any
+}
+
+// loadJWTKeySet builds a jwtKeySet from the following environment variables:
+//   - JWT_SIGNING_ALG is the algorithm used to sign tokens, either "HS256"
+//     (the default) or "EdDSA".
+//   - JWT_SIGNING_KEY is the base64-encoded signing key; an HS256 secret or
+//     an Ed25519 seed. It may be omitted in EdDSA mode, in which case this
+//     instance can verify tokens but not issue them.
+//   - JWT_SIGNING_KEY_ID is the ID of the signing key (default "0").
+//   - JWT_VERIFICATION_KEYS is an optional comma-separated list of additional
+//     keys to accept, each in the form <key ID>:<algorithm>:<base64 key>. For
+//     EdDSA, the key is the Ed25519 public key.
+func loadJWTKeySet() (*jwtKeySet, error) {
+	ks := &jwtKeySet{verificationKeys: map[string]jwtKey{}}
+	alg, ok := os.LookupEnv("JWT_SIGNING_ALG")
+	if !ok {
+		alg = "HS256"
+	}
+	method, err := lookupSigningMethod(alg)
+	if err != nil {
+		return nil, err
+	}
+	signingKeyBase64, hasSigningKey := os.LookupEnv("JWT_SIGNING_KEY")
+	if hasSigningKey {
+		keyID, ok := os.LookupEnv("JWT_SIGNING_KEY_ID")
+		if !ok {
+			keyID = "0"
+		}
+		if keyID == "" {
+			return nil, errors.New("JWT_SIGNING_KEY_ID is empty")
+		}
+		b, err := base64.StdEncoding.DecodeString(signingKeyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode signing key: %w", err)
+		}
+		ks.signingKeyID = keyID
+		ks.signingMethod = method
+		if method == jwt.SigningMethodEdDSA {
+			if len(b) != ed25519.SeedSize {
+				return nil, errors.New("EdDSA signing key must be a 32-byte seed")
+			}
+			privateKey := ed25519.NewKeyFromSeed(b)
+			ks.signingKey = privateKey
+			ks.verificationKeys[keyID] = jwtKey{method, privateKey.Public()}
+		} else {
+			ks.signingKey = b
+			ks.verificationKeys[keyID] = jwtKey{method, b}
+		}
+	} else if method != jwt.SigningMethodEdDSA {
+		return nil, errors.New("JWT_SIGNING_KEY not set")
+	}
+	if s, ok := os.LookupEnv("JWT_VERIFICATION_KEYS"); ok && s != "" {
+		for _, entry := range strings.Split(s, ",") {
+			keyID, key, err := parseVerificationKey(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := ks.verificationKeys[keyID]; exists {
+				return nil, fmt.Errorf("duplicate key ID %q", keyID)
+			}
+			ks.verificationKeys[keyID] = key
+		}
+	}
+	if len(ks.verificationKeys) == 0 {
+		return nil, errors.New("no JWT keys configured")
+	}
+	return ks, nil
+}
+
+// parseVerificationKey parses an entry of JWT_VERIFICATION_KEYS.
+func parseVerificationKey(entry string) (keyID string, key jwtKey, err error) {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return "", key, fmt.Errorf("malformed verification key %q", entry)
+	}
+	keyID = parts[0]
+	key.method, err = lookupSigningMethod(parts[1])
+	if err != nil {
+		return "", key, err
+	}
+	b, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", key, fmt.Errorf("failed to decode verification key %q: %w", keyID, err)
+	}
+	if key.method == jwt.SigningMethodEdDSA {
+		if len(b) != ed25519.PublicKeySize {
+			return "", key, fmt.Errorf("EdDSA verification key %q must be a 32-byte public key", keyID)
+		}
+		key.key = ed25519.PublicKey(b)
+	} else {
+		key.key = b
+	}
+	return keyID, key, nil
+}
+
+func lookupSigningMethod(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case "HS256":
+		return jwt.SigningMethodHS256, nil
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+}
+
+// sign returns a token containing the given claims, signed with the signing
+// key.
+func (ks *jwtKeySet) sign(claims jwt.Claims) (string, error) {
+	if ks.signingKey == nil {
+		return "", errors.New("this instance has no JWT signing key")
+	}
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	token.Header["kid"] = ks.signingKeyID
+	return token.SignedString(ks.signingKey)
+}
+
+// keyFunc is a jwt.Keyfunc that selects the verification key named by the
+// token's "kid" header. Tokens without a "kid" header were issued before key
+// IDs were introduced, and are verified with the signing key.
+func (ks *jwtKeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	keyID, ok := t.Header["kid"].(string)
+	if !ok {
+		keyID = ks.signingKeyID
+	}
+	key, ok := ks.verificationKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", keyID)
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %q does not accept algorithm %v", keyID, t.Method.Alg())
+	}
+	return key.key, nil
+}
+
+// validMethods returns the algorithms of every verification key.
+func (ks *jwtKeySet) validMethods() []string {
+	var methods []string
+	seen := map[string]bool{}
+	for _, k := range ks.verificationKeys {
+		if alg := k.method.Alg(); !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
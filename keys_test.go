@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// setJWTEnv sets the JWT_ environment variables for the duration of the test.
+// An empty value is set as "" rather than left unset.
+func setJWTEnv(t *testing.T, alg, key, keyID, verificationKeys string) {
+	t.Helper()
+	t.Setenv("JWT_SIGNING_ALG", alg)
+	t.Setenv("JWT_SIGNING_KEY", key)
+	t.Setenv("JWT_SIGNING_KEY_ID", keyID)
+	t.Setenv("JWT_VERIFICATION_KEYS", verificationKeys)
+}
+
+func parseToken(ks *jwtKeySet, token string) error {
+	_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, ks.keyFunc,
+		jwt.WithValidMethods(ks.validMethods()))
+	return err
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	oldSecret := base64.StdEncoding.EncodeToString([]byte("old secret, at least 32 bytes long"))
+	newSecret := base64.StdEncoding.EncodeToString([]byte("new secret, at least 32 bytes long"))
+
+	setJWTEnv(t, "HS256", oldSecret, "1", "")
+	oldKeys, err := loadJWTKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := oldKeys.sign(&jwt.RegisteredClaims{Subject: "u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After rotation, tokens signed with the old key are still accepted
+	// while it is listed in JWT_VERIFICATION_KEYS.
+	setJWTEnv(t, "HS256", newSecret, "2", "1:HS256:"+oldSecret)
+	ks, err := loadJWTKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := ks.sign(&jwt.RegisteredClaims{Subject: "u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parseToken(ks, newToken); err != nil {
+		t.Errorf("token signed with the new key: %v", err)
+	}
+	if err := parseToken(ks, oldToken); err != nil {
+		t.Errorf("token signed with the old key: %v", err)
+	}
+
+	// Once the old key is retired, its tokens are rejected.
+	setJWTEnv(t, "HS256", newSecret, "2", "")
+	retired, err := loadJWTKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parseToken(retired, oldToken); err == nil || !strings.Contains(err.Error(), `unknown key ID "1"`) {
+		t.Errorf("token signed with a retired key: err = %v", err)
+	}
+	if err := parseToken(retired, newToken); err != nil {
+		t.Errorf("token signed with the new key: %v", err)
+	}
+}
+
+func TestJWTKeyFunc(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("secret, at least 32 bytes long..."))
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setJWTEnv(t, "HS256", secret, "h", "e:EdDSA:"+base64.StdEncoding.EncodeToString(pub))
+	ks, err := loadJWTKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(method jwt.SigningMethod, kid any, key any) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, &jwt.RegisteredClaims{Subject: "u"})
+		if kid != nil {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	hsKey, _ := base64.StdEncoding.DecodeString(secret)
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256 key", sign(jwt.SigningMethodHS256, "h", hsKey), true},
+		{"EdDSA key", sign(jwt.SigningMethodEdDSA, "e", priv), true},
+		// Tokens issued before key IDs were introduced.
+		{"no kid", sign(jwt.SigningMethodHS256, nil, hsKey), true},
+		{"unknown kid", sign(jwt.SigningMethodHS256, "x", hsKey), false},
+		{"non-string kid", sign(jwt.SigningMethodHS256, 1, hsKey), true},
+		// An attacker can't choose which algorithm a key is used with.
+		{"wrong algorithm", sign(jwt.SigningMethodHS256, "e", []byte(pub)), false},
+		{"wrong key", sign(jwt.SigningMethodHS256, "h", []byte("other secret")), false},
+	}
+	for _, tt := range tests {
+		if err := parseToken(ks, tt.token); (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestLoadJWTKeySetErrors(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("secret"))
+	tests := []struct {
+		name                              string
+		alg, key, keyID, verificationKeys string
+	}{
+		{"empty key ID", "HS256", secret, "", ""},
+		{"unsupported algorithm", "RS256", secret, "0", ""},
+		{"short EdDSA seed", "EdDSA", secret, "0", ""},
+		{"malformed verification key", "HS256", secret, "0", "1:HS256"},
+		{"duplicate key ID", "HS256", secret, "0", "0:HS256:" + secret},
+	}
+	for _, tt := range tests {
+		setJWTEnv(t, tt.alg, tt.key, tt.keyID, tt.verificationKeys)
+		if _, err := loadJWTKeySet(); err == nil {
+			t.Errorf("%v: loadJWTKeySet succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Each user is a member of one or more todo lists, each with its own version.
+// One of them is the user's default list, which is created along with the
+// user and can't be deleted or archived. Todo operations apply to the default
+// list unless the request names another list (see listRef).
+//
+// A member's role determines what they can do with a list. Viewers can read
+// the list, editors can also change its todos, and the owner, who created the
+// list, can also rename, archive, delete, and share it. The owner shares a
+// list by adding other users as editors or viewers.
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+// roleRanks orders the roles by the permissions they grant. Each role grants
+// the permissions of the roles below it.
+var roleRanks = map[string]int{roleViewer: 1, roleEditor: 2, roleOwner: 3}
+
+// defaultListName is the name of the list created for each new user.
+const defaultListName = "Todos"
+
+var errListNotFound = &errorResp{Code: "listNotFound", Message: "the list does not exist"}
+
+var errDefaultList = &errorResp{
+	Code:    "defaultList",
+	Message: "the default list can't be deleted or archived",
+}
+
+// lookupList gets the given user's membership of the list with the given ID,
+// or of the user's default list if listID is "". role is "" if the list
+// doesn't exist or the user isn't a member. If an error occurs, lookupList
+// logs the error and sets ok to false.
+func lookupList(ctx context.Context, tx pgx.Tx, uid string, listID string) (id string, role string, isDefault bool, ok bool) {
+	var row pgx.Row
+	if listID == "" {
+		query := "SELECT list_id, role, is_default FROM list_members WHERE user_id = $1 AND is_default"
+		row = tx.QueryRow(ctx, query, uid)
+	} else {
+		query := "SELECT list_id, role, is_default FROM list_members WHERE list_id = $1 AND user_id = $2"
+		row = tx.QueryRow(ctx, query, listID, uid)
+	}
+	err := row.Scan(&id, &role, &isDefault)
+	if err == pgx.ErrNoRows {
+		return "", "", false, true
+	}
+	if err != nil {
+		log.Printf("Failed to look up list ID \"%v\" for UID %v: %v", listID, uid, err)
+		return "", "", false, false
+	}
+	return id, role, isDefault, true
+}
+
+// resolveList returns the ID of the list that a request from the given user
+// refers to: listID if it's set, or the user's default list otherwise. It also
+// checks that the user's role grants the permissions of the role need. If not,
+// e describes the problem. If an error occurs, resolveList logs the error and
+// sets ok to false.
+func resolveList(ctx context.Context, tx pgx.Tx, uid string, listID string, need string) (id string, e *errorResp, ok bool) {
+	id, role, _, ok := lookupList(ctx, tx, uid, listID)
+	if !ok {
+		return "", nil, false
+	}
+	if e := checkRole(role, need); e != nil {
+		return "", e, true
+	}
+	return id, nil, true
+}
+
+// checkRole returns an *errorResp if the role has doesn't grant the
+// permissions of the role need. An empty role means that the user isn't a
+// member of the list, so the list is reported as nonexistent.
+func checkRole(has string, need string) *errorResp {
+	if has == "" {
+		return errListNotFound
+	}
+	if roleRanks[has] < roleRanks[need] {
+		return &errorResp{
+			Code:    "forbidden",
+			Message: fmt.Sprintf("the operation requires the %v role", need),
+		}
+	}
+	return nil
+}
+
+// createList inserts a new, empty list with the given name, owned by the
+// given user, and returns the new list ID. If an error occurs, createList logs
+// the error and returns "".
+func createList(ctx context.Context, tx pgx.Tx, uid string, name string, isDefault bool) (listID string) {
+	listID = uuid.NewString()
+	cmd := "INSERT INTO lists (id, name, version) VALUES ($1, $2, 0)"
+	if _, err := tx.Exec(ctx, cmd, listID, name); err != nil {
+		log.Printf("Failed to create list for UID %v: %v", uid, err)
+		return ""
+	}
+	cmd = "INSERT INTO list_members (list_id, user_id, role, is_default) VALUES ($1, $2, $3, $4)"
+	if _, err := tx.Exec(ctx, cmd, listID, uid, roleOwner, isDefault); err != nil {
+		log.Printf("Failed to add owner to list with ID %v and UID %v: %v", listID, uid, err)
+		return ""
+	}
+	return listID
+}
+
+func (h *apiHandler) serveGetLists(ctx context.Context, w http.ResponseWriter, r *getListsRqst, uid string) {
+	resp := h.txGetLists(ctx, uid, r.IncludeArchived)
+	if resp == nil {
+		writeServerError(ctx, w)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func (h *apiHandler) txGetLists(ctx context.Context, uid string, includeArchived bool) (resp *getListsResp) {
+	h.runTx(ctx, pgx.ReadOnly, func(tx pgx.Tx) bool {
+		query := `
+			SELECT l.id, l.name, l.version, m.role, m.is_default, l.archived
+			FROM lists l JOIN list_members m ON m.list_id = l.id
+			WHERE m.user_id = $1 AND (NOT l.archived OR $2)
+			ORDER BY NOT m.is_default, l.created`
+		rows, err := tx.Query(ctx, query, uid, includeArchived)
+		if err != nil {
+			log.Printf("Failed to get lists for UID %v: %v", uid, err)
+			return false
+		}
+		lists, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (listInfo, error) {
+			var l listInfo
+			err := row.Scan(&l.ID, &l.Name, &l.Version, &l.Role, &l.Default, &l.Archived)
+			return l, err
+		})
+		if err != nil {
+			log.Printf("Failed to iterate over query result while getting lists "+
+				"for UID %v: %v", uid, err)
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		resp = &getListsResp{Lists: lists}
+		return true
+	})
+	return resp
+}
+
+func (h *apiHandler) serveCreateList(ctx context.Context, w http.ResponseWriter, r *createListRqst, uid string) {
+	var listID string
+	ok := h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		listID = createList(ctx, tx, uid, r.Name, false)
+		if listID == "" {
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		return true
+	})
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	writeJSON(w, &listInfo{ID: listID, Name: r.Name, Role: roleOwner})
+}
+
+func (h *apiHandler) serveRenameList(ctx context.Context, w http.ResponseWriter, r *renameListRqst, uid string) {
+	h.serveUpdateList(ctx, w, uid, r.ListID, false, "UPDATE lists SET name = $1 WHERE id = $2", r.Name)
+}
+
+func (h *apiHandler) serveArchiveList(ctx context.Context, w http.ResponseWriter, r *archiveListRqst, uid string) {
+	h.serveUpdateList(ctx, w, uid, r.ListID, true, "UPDATE lists SET archived = $1 WHERE id = $2", r.Archived)
+}
+
+// serveUpdateList runs a transaction that changes the list with the given ID
+// by executing cmd, whose parameters are the given value and the list ID. If
+// notDefault is true, the default list can't be changed. Only the owner can
+// change the list.
+func (h *apiHandler) serveUpdateList(ctx context.Context, w http.ResponseWriter, uid string, listID string, notDefault bool, cmd string, value any) {
+	e, ok := h.txWithList(ctx, pgx.ReadWrite, uid, listID, roleOwner, func(tx pgx.Tx, _ string, isDefault bool) (*errorResp, bool) {
+		if notDefault && isDefault {
+			return errDefaultList, true
+		}
+		if _, err := tx.Exec(ctx, cmd, value, listID); err != nil {
+			log.Printf("Failed to update list with ID %v: %v", listID, err)
+			return nil, false
+		}
+		return nil, true
+	})
+	writeListResult(ctx, w, e, ok)
+}
+
+func (h *apiHandler) serveDeleteList(ctx context.Context, w http.ResponseWriter, r *deleteListRqst, uid string) {
+	e, ok := h.txWithList(ctx, pgx.ReadWrite, uid, r.ListID, roleOwner, func(tx pgx.Tx, _ string, isDefault bool) (*errorResp, bool) {
+		if isDefault {
+			return errDefaultList, true
+		}
+		for _, cmd := range []string{
+			"DELETE FROM todo_changes WHERE list_id = $1",
+			"DELETE FROM todos WHERE list_id = $1",
+			"DELETE FROM list_members WHERE list_id = $1",
+			"DELETE FROM lists WHERE id = $1",
+		} {
+			if _, err := tx.Exec(ctx, cmd, r.ListID); err != nil {
+				log.Printf("Failed to delete list with ID %v: %v", r.ListID, err)
+				return nil, false
+			}
+		}
+		return nil, notifyChange(ctx, tx, r.ListID, 0)
+	})
+	writeListResult(ctx, w, e, ok)
+}
+
+func (h *apiHandler) serveShareList(ctx context.Context, w http.ResponseWriter, r *shareListRqst, uid string) {
+	e, ok := h.txWithList(ctx, pgx.ReadWrite, uid, r.ListID, roleOwner, func(tx pgx.Tx, _ string, _ bool) (*errorResp, bool) {
+		memberUID, role, ok := lookupMember(ctx, tx, r.ListID, r.Username)
+		if !ok {
+			return nil, false
+		}
+		if memberUID == "" {
+			return errUserNotFound, true
+		}
+		if role == roleOwner {
+			return &errorResp{Code: "isOwner", Message: "the owner's role can't be changed"}, true
+		}
+		cmd := `
+			INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (list_id, user_id) DO UPDATE SET role = EXCLUDED.role`
+		if _, err := tx.Exec(ctx, cmd, r.ListID, memberUID, r.Role); err != nil {
+			log.Printf("Failed to share list with ID %v with UID %v: %v", r.ListID, memberUID, err)
+			return nil, false
+		}
+		return nil, true
+	})
+	writeListResult(ctx, w, e, ok)
+}
+
+func (h *apiHandler) serveUnshareList(ctx context.Context, w http.ResponseWriter, r *unshareListRqst, uid string) {
+	// Any member may remove themselves, so the owner's role is checked below.
+	e, ok := h.txWithList(ctx, pgx.ReadWrite, uid, r.ListID, roleViewer, func(tx pgx.Tx, myRole string, _ bool) (*errorResp, bool) {
+		memberUID, role, ok := lookupMember(ctx, tx, r.ListID, r.Username)
+		if !ok {
+			return nil, false
+		}
+		if memberUID == "" {
+			return errUserNotFound, true
+		}
+		if memberUID != uid {
+			if e := checkRole(myRole, roleOwner); e != nil {
+				return e, true
+			}
+		}
+		if role == "" {
+			return &errorResp{Code: "notMember", Message: "the user isn't a member of the list"}, true
+		}
+		if role == roleOwner {
+			return &errorResp{Code: "isOwner", Message: "the owner can't be removed from the list"}, true
+		}
+		cmd := "DELETE FROM list_members WHERE list_id = $1 AND user_id = $2"
+		if _, err := tx.Exec(ctx, cmd, r.ListID, memberUID); err != nil {
+			log.Printf("Failed to unshare list with ID %v with UID %v: %v", r.ListID, memberUID, err)
+			return nil, false
+		}
+		return nil, notifyChange(ctx, tx, r.ListID, 0)
+	})
+	writeListResult(ctx, w, e, ok)
+}
+
+var errUserNotFound = &errorResp{Code: "userNotFound", Message: "the user does not exist"}
+
+// lookupMember gets the user ID of the user with the given username, and that
+// user's role in the list with the given ID. uid is "" if the user doesn't
+// exist, and role is "" if the user isn't a member of the list. If an error
+// occurs, lookupMember logs the error and sets ok to false.
+func lookupMember(ctx context.Context, tx pgx.Tx, listID string, username string) (uid string, role string, ok bool) {
+	query := `
+		SELECT u.id, coalesce(m.role, '') FROM users u
+		LEFT JOIN list_members m ON m.user_id = u.id AND m.list_id = $1
+		WHERE u.name = $2`
+	err := tx.QueryRow(ctx, query, listID, username).Scan(&uid, &role)
+	if err == pgx.ErrNoRows {
+		return "", "", true
+	}
+	if err != nil {
+		log.Printf("Failed to look up member \"%v\" of list with ID %v: %v", username, listID, err)
+		return "", "", false
+	}
+	return uid, role, true
+}
+
+func (h *apiHandler) serveGetListMembers(ctx context.Context, w http.ResponseWriter, r *getListMembersRqst, uid string) {
+	var resp *getListMembersResp
+	e, ok := h.txWithList(ctx, pgx.ReadOnly, uid, r.ListID, roleViewer, func(tx pgx.Tx, _ string, _ bool) (*errorResp, bool) {
+		query := `
+			SELECT u.name, m.role FROM list_members m JOIN users u ON u.id = m.user_id
+			WHERE m.list_id = $1 ORDER BY m.role = 'owner' DESC, u.name`
+		rows, err := tx.Query(ctx, query, r.ListID)
+		if err != nil {
+			log.Printf("Failed to get members of list with ID %v: %v", r.ListID, err)
+			return nil, false
+		}
+		members, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (listMember, error) {
+			var m listMember
+			err := row.Scan(&m.Username, &m.Role)
+			return m, err
+		})
+		if err != nil {
+			log.Printf("Failed to iterate over query result while getting members "+
+				"of list with ID %v: %v", r.ListID, err)
+			return nil, false
+		}
+		resp = &getListMembersResp{Members: members}
+		return nil, true
+	})
+	if e != nil || !ok {
+		writeListResult(ctx, w, e, ok)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// txWithList runs a transaction with the given access mode that checks that
+// the given user's role in the list with the given ID grants the permissions
+// of the role need, and then calls f with the user's role. f returns an
+// *errorResp if the request is invalid, or sets ok to false if an error
+// occurs. If the user's role isn't sufficient, txWithList returns an
+// *errorResp without calling f. f may be called more than once (see runTx).
+func (h *apiHandler) txWithList(ctx context.Context, mode pgx.TxAccessMode, uid string, listID string, need string, f func(tx pgx.Tx, role string, isDefault bool) (*errorResp, bool)) (e *errorResp, ok bool) {
+	ok = h.runTx(ctx, mode, func(tx pgx.Tx) bool {
+		_, role, isDefault, ok := lookupList(ctx, tx, uid, listID)
+		if !ok {
+			return false
+		}
+		if e = checkRole(role, need); e != nil {
+			return true
+		}
+		e, ok = f(tx, role, isDefault)
+		if e != nil || !ok {
+			return ok
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		return true
+	})
+	return e, ok
+}
+
+// writeListResult writes the response for the given result of txWithList,
+// for requests that don't return any JSON.
+func writeListResult(ctx context.Context, w http.ResponseWriter, e *errorResp, ok bool) {
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if e != nil {
+		writeError(w, http.StatusBadRequest, e.Code, e.Message)
+	}
+}
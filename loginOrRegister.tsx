@@ -139,6 +139,8 @@ function CreateUserForm({ onShowLoginForm, onLoggedIn }: CreateUserFormProps) {
     confirmPassword: "",
     isCreatingUser: false,
     isUsernameTaken: false,
+    usernameError: "",
+    passwordError: "",
   });
 
   const actions = useContext(ActionsContext);
@@ -158,6 +160,11 @@ function CreateUserForm({ onShowLoginForm, onLoggedIn }: CreateUserFormProps) {
       username,
       password,
       onUsernameTaken: () => setState({ ...state, isUsernameTaken: true }),
+      onFieldRejected: (field, message) => setState({
+        ...state,
+        usernameError: field === "username" ? message : "",
+        passwordError: field === "password" ? message : "",
+      }),
       onLoggedIn: () => onLoggedIn(username)
     })
   }
@@ -168,6 +175,11 @@ function CreateUserForm({ onShowLoginForm, onLoggedIn }: CreateUserFormProps) {
       error: true,
       helperText: "Username already taken.",
     }
+  } else if (state.usernameError !== "") {
+    usernameProps = {
+      error: true,
+      helperText: state.usernameError,
+    }
   }
   let passwordProps;
   if (state.password !== state.confirmPassword) {
@@ -175,6 +187,11 @@ function CreateUserForm({ onShowLoginForm, onLoggedIn }: CreateUserFormProps) {
       error: true,
       helperText: "Passwords must match.",
     }
+  } else if (state.passwordError !== "") {
+    passwordProps = {
+      error: true,
+      helperText: state.passwordError,
+    }
   }
   const style = { margin: "10px 0" };
   return (
@@ -2,23 +2,27 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "./main.html")
 	})
@@ -26,96 +30,156 @@ func main() {
 		http.ServeFile(w, r, "./main.js")
 	})
 
-	jwtSigningKeyBase64, ok := os.LookupEnv("JWT_SIGNING_KEY")
-	if !ok {
-		log.Fatal("JWT_SIGNING_KEY not set")
-	}
-	jwtSigningKey, err := base64.StdEncoding.DecodeString(jwtSigningKeyBase64)
+	jwtKeys, err := loadJWTKeySet()
 	if err != nil {
-		log.Fatalf("Failed to decode signing key: %v", err)
+		log.Fatalf("Failed to load JWT keys: %v", err)
 	}
 
-	dbURL, ok := os.LookupEnv("DB_URL")
-	if !ok {
-		log.Fatal("DB_URL not set")
+	sessionLifetime := lookupEnvDuration("SESSION_LIFETIME", 7*24*time.Hour)
+	resetTokenLifetime := lookupEnvDuration("PASSWORD_RESET_TOKEN_LIFETIME", time.Hour)
+
+	pwdHasher, err := newPasswordHasher(lookupEnvInt("PASSWORD_HASH_COST", 12))
+	if err != nil {
+		log.Fatalf("Failed to create password hasher: %v", err)
 	}
-	pool, err := pgxpool.New(context.Background(), dbURL)
+
+	notifier, err := newNotifier()
 	if err != nil {
-		log.Fatalf("Failed to create database connection pool: %v\n", err)
+		log.Fatalf("Failed to create notifier: %v", err)
 	}
-	defer pool.Close()
 
-	http.Handle("/api", &apiHandler{
-		pool:          pool,
-		jwtSigningKey: jwtSigningKey,
-		cookieName:    "accessToken",
-	})
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
+	timeouts, err := loadOpTimeouts()
+	if err != nil {
+		log.Fatalf("Failed to load operation timeouts: %v", err)
+	}
 
-type apiHandler struct {
-	pool          *pgxpool.Pool
-	jwtSigningKey []byte
-	cookieName    string
-}
+	pool := newDBPool(connectDB())
+	defer pool.Close()
+	registerPoolMetrics(pool)
 
-func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusBadRequest)
-	}
-	body, err := io.ReadAll(r.Body)
+	migrations, err := loadMigrations()
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		log.Fatalf("Failed to load migrations: %v", err)
 	}
-	lr := &loginRqst{}
-	if err := json.Unmarshal(body, lr); err == nil && lr.Operation == "login" {
-		h.serveLogin(w, lr)
-		return
-	}
-	lor := &logoutRqst{}
-	if err := json.Unmarshal(body, lor); err == nil && lor.Operation == "logout" {
-		writeDeleteCookie(w, h.cookieName)
-		return
+	if lookupEnvBool("MIGRATE_ON_STARTUP", true) {
+		err = migrate(context.Background(), pool.Pool, migrations, len(migrations), "up", false)
+		if err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
 	}
-	gur := &getUsernameRqst{}
-	if err := json.Unmarshal(body, gur); err == nil && gur.Operation == "getUsername" {
-		h.serveGetUsername(w, r)
-		return
+
+	throttleStore, err := newThrottleStore(pool)
+	if err != nil {
+		log.Fatalf("Failed to create throttle store: %v", err)
 	}
-	cur := &createUserRqst{}
-	if err := json.Unmarshal(body, cur); err == nil && cur.Operation == "createUser" {
-		h.serveCreateUser(w, cur)
-		return
+
+	changes := newChangeHub()
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	listenDone := make(chan struct{})
+	go func() {
+		changes.listen(listenCtx, pool.Pool)
+		close(listenDone)
+	}()
+
+	draining := make(chan struct{})
+	shutdown := make(chan struct{})
+
+	api := &apiHandler{
+		pool:               pool,
+		jwtKeys:            jwtKeys,
+		cookieName:         "accessToken",
+		cookieAttrs:        newCookieAttrs(),
+		origins:            newOriginChecker(),
+		pwdHasher:          pwdHasher,
+		sessionLifetime:    sessionLifetime,
+		changes:            changes,
+		notifier:           notifier,
+		throttles:          newLoginThrottles(throttleStore),
+		resetTokenLifetime: resetTokenLifetime,
+		timeouts:           timeouts,
+		shutdown:           shutdown,
+	}
+	http.Handle("/api", api)
+	openAPI, err := openAPIHandler()
+	if err != nil {
+		log.Fatalf("Failed to generate OpenAPI document: %v", err)
+	}
+	http.Handle("/api/openapi.json", openAPI)
+	http.Handle("/api/v1/", &restHandler{api})
+	http.HandleFunc("/api/events", api.serveEvents)
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/healthz", serveHealth)
+	http.Handle("/readyz", &readinessHandler{pool, len(migrations), draining})
+	serveUntilSignaled(newServer(), draining, shutdown)
+
+	// The listener's connection must be released before the pool can close.
+	stopListening()
+	<-listenDone
+	pool.Close()
+	log.Println("Shut down")
+}
+
+// lookupEnvInt returns the integer value of the named environment variable,
+// or def if the variable is not set. It exits the program if the variable is
+// set but is not an integer.
+func lookupEnvInt(name string, def int) int {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return def
 	}
-	gtr := &getTodosRqst{}
-	if err := json.Unmarshal(body, gtr); err == nil && gtr.Operation == "getTodos" {
-		withVerifyCookie(func(uid string) { h.serveGetTodos(w, uid) })(h, w, r)
-		return
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("Failed to parse %v: %v", name, err)
 	}
-	dtr := &deleteTodoRqst{}
-	if err := json.Unmarshal(body, dtr); err == nil && dtr.Operation == "deleteTodo" {
-		withVerifyCookie(func(uid string) { h.serveDeleteTodo(w, dtr, uid) })(h, w, r)
-		return
+	return v
+}
+
+// lookupEnvBool returns the boolean value of the named environment variable
+// (e.g. "true" or "false"), or def if the variable is not set. It exits the
+// program if the variable is set but is not a boolean.
+func lookupEnvBool(name string, def bool) bool {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return def
 	}
-	utr := &updateTodoRqst{}
-	if err := json.Unmarshal(body, utr); err == nil && utr.Operation == "updateTodo" {
-		withVerifyCookie(func(uid string) { h.serveUpdateTodo(w, utr, uid) })(h, w, r)
-		return
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Fatalf("Failed to parse %v: %v", name, err)
 	}
-	atr := &appendTodoRqst{}
-	if err := json.Unmarshal(body, atr); err == nil && atr.Operation == "appendTodo" {
-		withVerifyCookie(func(uid string) { h.serveAppendTodo(w, atr, uid) })(h, w, r)
-		return
+	return v
+}
+
+// lookupEnvDuration returns the value of the named environment variable
+// parsed as a time.Duration (e.g. "24h"), or def if the variable is not set.
+// It exits the program if the variable is set but is not a valid duration.
+func lookupEnvDuration(name string, def time.Duration) time.Duration {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return def
 	}
-	rtr := &refreshTodosRqst{}
-	if err := json.Unmarshal(body, rtr); err == nil && rtr.Operation == "refreshTodos" {
-		withVerifyCookie(func(uid string) { h.serveRefreshTodos(w, rtr, uid) })(h, w, r)
-		return
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatalf("Failed to parse %v: %v", name, err)
 	}
-	log.Printf("received invalid or unrecognized JSON: %s", body)
-	w.WriteHeader(http.StatusBadRequest)
+	return v
+}
+
+type apiHandler struct {
+	pool            *dbPool
+	jwtKeys         *jwtKeySet
+	cookieName      string
+	cookieAttrs     cookieAttrs
+	origins         *originChecker
+	pwdHasher       *passwordHasher
+	sessionLifetime time.Duration
+	changes         *changeHub
+	notifier        notifier
+	throttles       *loginThrottles
+	// resetTokenLifetime is how long a password reset token can be used.
+	resetTokenLifetime time.Duration
+	timeouts           *opTimeouts
+	// shutdown is closed when the server starts shutting down.
+	shutdown <-chan struct{}
 }
 
 // verifyCookie verifies the signature of the access token stored in the given
@@ -135,35 +199,37 @@ func (h *apiHandler) verifyCookie(w http.ResponseWriter, r *http.Request) string
 	c, err := r.Cookie(h.cookieName)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "notLoggedIn", "the operation requires login")
 		return ""
 	}
-	return h.getUIDFromJwt(w, c.Value)
+	return h.getUIDFromJwt(r.Context(), w, c.Value)
 }
 
-// getUIDFromJwt verifies the JWT and extracts the user ID.
+// getUIDFromJwt verifies the JWT, checks that its session is still valid, and
+// extracts the user ID.
+//
+// If the session has expired or been revoked, then the containing cookie is
+// deleted and http.StatusUnauthorized is sent.
 //
 // If the JWT can't be verified, then the containing cookie is deleted and
 // http.StatusInternalServerError is sent. Since the server is responsible for
 // generating the JWT in the first place, a potential server programming error
 // is indicated. There could be another cause (like a forgery attempt), but we
 // shouldn't hide programming errors.
-func (h *apiHandler) getUIDFromJwt(w http.ResponseWriter, tokenString string) string {
-	token, err := jwt.Parse(
-		tokenString,
-		func(t *jwt.Token) (interface{}, error) {
-			return h.jwtSigningKey, nil
-		},
-		jwt.WithValidMethods([]string{"HS256"}),
-	)
+func (h *apiHandler) getUIDFromJwt(ctx context.Context, w http.ResponseWriter, tokenString string) string {
+	claims, err := h.checkSession(ctx, w, tokenString)
+	if err == errSessionInvalid {
+		h.writeDeleteCookie(w)
+		writeError(w, http.StatusUnauthorized, "sessionExpired", "the session has expired or been revoked")
+		return ""
+	}
 	if err != nil {
 		log.Println(err)
-		writeDeleteCookie(w, h.cookieName)
-		w.WriteHeader(http.StatusInternalServerError)
+		h.writeDeleteCookie(w)
+		writeServerError(ctx, w)
 		return ""
 	}
-	claims := token.Claims.(jwt.MapClaims)
-	return claims["uid"].(string)
+	return claims.UID
 }
 
 // withVerifyCookie returns a new function that:
@@ -179,74 +245,114 @@ func withVerifyCookie(f func(string)) func(*apiHandler, http.ResponseWriter, *ht
 }
 
 // writeDeleteCookie writes a response header that instructs the client to
-// delete the named cookie.
-func writeDeleteCookie(w http.ResponseWriter, cookieName string) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   cookieName,
-		MaxAge: -1,
-	})
+// delete the access token cookie.
+func (h *apiHandler) writeDeleteCookie(w http.ResponseWriter) {
+	c := h.newCookie("")
+	c.MaxAge = -1
+	http.SetCookie(w, c)
 }
 
-func (h *apiHandler) serveLogin(w http.ResponseWriter, r *loginRqst) {
-	uid, pwd, err := getUIDAndPassword(h.pool, r.Username)
-	if err == pgx.ErrNoRows {
-		writeJSON(w, &loginResp{DidLogin: false})
-		return
-	}
-	if err != nil {
-		log.Printf("Failed to get UID and password for name \"%v\": %v", r.Username, err)
-		w.WriteHeader(http.StatusInternalServerError)
+func (h *apiHandler) serveLogin(ctx context.Context, w http.ResponseWriter, r *loginRqst, ip string) {
+	cookie, wait, ok := h.login(ctx, r, ip)
+	if !ok {
+		writeServerError(ctx, w)
 		return
 	}
-	if r.Password != pwd {
-		writeJSON(w, &loginResp{DidLogin: false})
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
 		return
 	}
-	cookie := h.createCookie(uid)
 	if cookie == nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, &loginResp{DidLogin: false})
 		return
 	}
 	http.SetCookie(w, cookie)
 	writeJSON(w, &loginResp{DidLogin: true})
 }
 
+// login checks the credentials in the given request, sent from the given IP
+// address, and, if they are valid, starts a new session and returns its
+// cookie. login returns a nil cookie if the credentials are invalid. If there
+// have been too many failed attempts to log in as the user or from the
+// address, the credentials aren't checked, and wait is how long the client
+// must wait before trying again (see loginThrottles). If an error occurs,
+// login logs the error and sets ok to false.
+func (h *apiHandler) login(ctx context.Context, r *loginRqst, ip string) (cookie *http.Cookie, wait time.Duration, ok bool) {
+	wait, ok = h.throttles.loginAttempt(ctx, ip, r.Username)
+	if wait > 0 || !ok {
+		return nil, wait, ok
+	}
+	uid, pwd, err := getUIDAndPassword(ctx, h.pool, r.Username)
+	if err == pgx.ErrNoRows {
+		h.pwdHasher.verifyDummy(r.Password)
+		return nil, 0, true
+	}
+	if err != nil {
+		log.Printf("Failed to get UID and password for name \"%v\": %v", r.Username, err)
+		return nil, 0, false
+	}
+	match, needsRehash := h.pwdHasher.verify(r.Password, pwd)
+	if !match {
+		return nil, 0, true
+	}
+	h.throttles.loginSucceeded(ctx, ip, r.Username)
+	if needsRehash {
+		// Failing to upgrade the stored password shouldn't prevent the user
+		// from logging in; we'll try again next time.
+		h.rehashPassword(ctx, uid, r.Password)
+	}
+	cookie = h.createCookie(ctx, h.pool, uid)
+	return cookie, 0, cookie != nil
+}
+
 // getUIDAndPassword gets the user ID and password for the given user name, or
 // returns an error. It returns pgx.ErrNoRows if the user name doesn't exist.
-func getUIDAndPassword(pool *pgxpool.Pool, name string) (uid string, pwd string, err error) {
+func getUIDAndPassword(ctx context.Context, pool *dbPool, name string) (uid string, pwd string, err error) {
 	query := "SELECT id, password FROM users WHERE name = $1"
-	row := pool.QueryRow(context.Background(), query, name)
+	row := pool.QueryRow(ctx, query, name)
 	err = row.Scan(&uid, &pwd)
 	return
 }
 
-func (h *apiHandler) createCookie(uid string) *http.Cookie {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": uid})
-	signedString, err := token.SignedString(h.jwtSigningKey)
+// rehashPassword replaces the stored password for the given user ID with a
+// hash of pwd computed with the current hash parameters. If an error occurs,
+// rehashPassword logs the error.
+func (h *apiHandler) rehashPassword(ctx context.Context, uid string, pwd string) {
+	hash, err := h.pwdHasher.hash(pwd)
 	if err != nil {
-		log.Printf("Failed to sign jwt: %v", err)
-		return nil
+		log.Printf("Failed to hash password for UID %v: %v", uid, err)
+		return
 	}
-	return &http.Cookie{
-		Name:     h.cookieName,
-		Value:    signedString,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
+	cmd := "UPDATE users SET password = $1 WHERE id = $2"
+	_, err = h.pool.Exec(ctx, cmd, hash, uid)
+	if err != nil {
+		log.Printf("Failed to rehash password for UID %v: %v", uid, err)
 	}
 }
 
 func (h *apiHandler) serveGetUsername(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	c, err := r.Cookie(h.cookieName)
 	if err != nil {
 		// User is not logged in.
 		writeJSON(w, &getUsernameResp{Username: ""})
 		return
 	}
-	uid := h.getUIDFromJwt(w, c.Value)
-	if uid == "" {
+	claims, err := h.checkSession(ctx, w, c.Value)
+	if err == errSessionInvalid {
+		// The user was logged out by the server.
+		h.writeDeleteCookie(w)
+		writeJSON(w, &getUsernameResp{Username: ""})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		h.writeDeleteCookie(w)
+		writeServerError(ctx, w)
 		return
 	}
-	username, err := getUsername(h.pool, uid)
+	uid := claims.UID
+	username, err := getUsername(ctx, h.pool, uid)
 	if err == pgx.ErrNoRows {
 		log.Println("Warning: client is logged in as a non-existent user.")
 		// This is not necessarily a client error. The user could have deleted
@@ -256,13 +362,13 @@ func (h *apiHandler) serveGetUsername(w http.ResponseWriter, r *http.Request) {
 		// properly and they've refreshed the page). In the future, to avoid
 		// this coupling, it might make more sense to check the user ID's
 		// existence earlier on - maybe when serving the js file?
-		writeDeleteCookie(w, h.cookieName)
+		h.writeDeleteCookie(w)
 		writeJSON(w, &getUsernameResp{Username: ""})
 		return
 	}
 	if err != nil {
 		log.Printf("Failed to get username for UID \"%v\": %v", uid, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(ctx, w)
 		return
 	}
 	writeJSON(w, &getUsernameResp{Username: username})
@@ -270,17 +376,26 @@ func (h *apiHandler) serveGetUsername(w http.ResponseWriter, r *http.Request) {
 
 // getUsername gets the username for the given user ID, or returns an error. It
 // returns pgx.ErrNoRows if the user ID doesn't exist.
-func getUsername(pool *pgxpool.Pool, uid string) (name string, err error) {
+func getUsername(ctx context.Context, pool *dbPool, uid string) (name string, err error) {
 	query := "SELECT name FROM users WHERE id = $1"
-	row := pool.QueryRow(context.Background(), query, uid)
+	row := pool.QueryRow(ctx, query, uid)
 	err = row.Scan(&name)
 	return
 }
 
-func (h *apiHandler) serveCreateUser(w http.ResponseWriter, r *createUserRqst) {
-	resp, cookie := h.txCreateUser(r)
+func (h *apiHandler) serveCreateUser(ctx context.Context, w http.ResponseWriter, r *createUserRqst, ip string) {
+	wait, ok := h.signupWait(ctx, ip)
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	resp, cookie := h.txCreateUser(ctx, r)
 	if resp == nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(ctx, w)
 		return
 	}
 	if cookie != nil {
@@ -289,48 +404,57 @@ func (h *apiHandler) serveCreateUser(w http.ResponseWriter, r *createUserRqst) {
 	writeJSON(w, resp)
 }
 
-func (h *apiHandler) txCreateUser(r *createUserRqst) (resp *createUserResp, cookie *http.Cookie) {
-	tx, err := h.pool.BeginTx(context.Background(), pgx.TxOptions{
-		IsoLevel:       pgx.Serializable,
-		AccessMode:     pgx.ReadWrite,
-		DeferrableMode: pgx.NotDeferrable,
-	})
-	defer rollback(tx)
-	if err != nil {
-		log.Printf("Failed to start transaction: %v", err)
-		return
-	}
-	exists, ok := checkUsername(tx, r.Username)
-	if !ok {
-		return
-	}
-	if exists {
-		resp = &createUserResp{IsNameTaken: true}
-		return
-	}
-	uid := createUser(tx, r.Username, r.Password)
-	if uid == "" {
-		return
-	}
-	c := h.createCookie(uid)
-	if c == nil {
-		return
-	}
-	err = tx.Commit(context.Background())
+// signupWait returns how long a client at the given IP address must wait
+// before creating an account, and counts the attempt (see loginThrottles).
+// If an error occurs, signupWait logs the error and sets ok to false.
+func (h *apiHandler) signupWait(ctx context.Context, ip string) (wait time.Duration, ok bool) {
+	return attemptAll(ctx, throttleKey{h.throttles.signup, ip})
+}
+
+func (h *apiHandler) txCreateUser(ctx context.Context, r *createUserRqst) (resp *createUserResp, cookie *http.Cookie) {
+	// Hash the password before starting the transaction, since hashing is
+	// deliberately slow.
+	pwdHash, err := h.pwdHasher.hash(r.Password)
 	if err != nil {
-		log.Printf("Failed to commit transaction: %v", err)
+		log.Printf("Failed to hash password: %v", err)
 		return
 	}
-	resp = &createUserResp{IsNameTaken: false}
-	cookie = c
+	h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		exists, ok := checkUsername(ctx, tx, r.Username)
+		if !ok {
+			return false
+		}
+		if exists {
+			resp = &createUserResp{IsNameTaken: true}
+			return true
+		}
+		uid := createUser(ctx, tx, r.Username, pwdHash)
+		if uid == "" {
+			return false
+		}
+		if createList(ctx, tx, uid, defaultListName, true) == "" {
+			return false
+		}
+		c := h.createCookie(ctx, tx, uid)
+		if c == nil {
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		resp = &createUserResp{IsNameTaken: false}
+		cookie = c
+		return true
+	})
 	return
 }
 
 // checkUsername checks whether the given username exists. If an error occurs,
 // checkUsername logs the error and sets ok to false.
-func checkUsername(tx pgx.Tx, name string) (exists bool, ok bool) {
+func checkUsername(ctx context.Context, tx pgx.Tx, name string) (exists bool, ok bool) {
 	query := "SELECT FROM users WHERE name = $1"
-	row := tx.QueryRow(context.Background(), query, name)
+	row := tx.QueryRow(ctx, query, name)
 	err := row.Scan()
 	if err == pgx.ErrNoRows {
 		exists = false
@@ -347,10 +471,13 @@ func checkUsername(tx pgx.Tx, name string) (exists bool, ok bool) {
 	return
 }
 
-func createUser(tx pgx.Tx, name string, pwd string) (uid string) {
+// createUser inserts a new user with the given name and password hash, and
+// returns the new user ID. If an error occurs, createUser logs the error and
+// returns "".
+func createUser(ctx context.Context, tx pgx.Tx, name string, pwdHash string) (uid string) {
 	uid = uuid.NewString()
-	cmd := "INSERT INTO users (id, name, password, version) VALUES ($1, $2, $3, 0)"
-	ct, err := tx.Exec(context.Background(), cmd, uid, name, pwd)
+	cmd := "INSERT INTO users (id, name, password) VALUES ($1, $2, $3)"
+	ct, err := tx.Exec(ctx, cmd, uid, name, pwdHash)
 	if err != nil {
 		log.Printf("Failed to create user with UID %v: %v", uid, err)
 		uid = ""
@@ -366,214 +493,301 @@ func createUser(tx pgx.Tx, name string, pwd string) (uid string) {
 	return
 }
 
-func (h *apiHandler) serveGetTodos(w http.ResponseWriter, uid string) {
-	resp := h.txGetTodos(uid)
-	if resp == nil {
-		w.WriteHeader(http.StatusInternalServerError)
+func (h *apiHandler) serveGetTodos(ctx context.Context, w http.ResponseWriter, r *getTodosRqst, uid string) {
+	resp, e, ok := h.txGetTodos(ctx, uid, r.ListID, r.Structured)
+	if !ok {
+		writeServerError(ctx, w)
+		return
+	}
+	if e != nil {
+		writeError(w, http.StatusBadRequest, e.Code, e.Message)
 		return
 	}
 	writeJSON(w, resp)
 }
 
-func (h *apiHandler) txGetTodos(uid string) *getTodosResp {
-	tx, err := h.pool.BeginTx(context.Background(), pgx.TxOptions{
-		IsoLevel:       pgx.Serializable,
-		AccessMode:     pgx.ReadOnly,
-		DeferrableMode: pgx.NotDeferrable,
+// txGetTodos gets the given user's todo list with the given ID (see
+// resolveList). structured determines the format of the todos (see todoList).
+// If the list doesn't exist or the user isn't a member, e describes the
+// problem. If an error occurs, txGetTodos logs the error and sets ok to false.
+func (h *apiHandler) txGetTodos(ctx context.Context, uid string, listID string, structured bool) (resp *getTodosResp, e *errorResp, ok bool) {
+	ok = h.runTx(ctx, pgx.ReadOnly, func(tx pgx.Tx) bool {
+		var id string
+		var ok bool
+		id, e, ok = resolveList(ctx, tx, uid, listID, roleViewer)
+		if !ok || e != nil {
+			return ok
+		}
+		version, ok := getVersion(ctx, tx, id)
+		if !ok {
+			return false
+		}
+		todos := getTodos(ctx, tx, id)
+		if todos == nil {
+			return false
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		resp = &getTodosResp{
+			ListID:  id,
+			Version: version,
+			Todos:   todoList{todos: todos, structured: structured},
+		}
+		return true
 	})
-	defer rollback(tx)
-	if err != nil {
-		log.Printf("Failed to start transaction: %v", err)
-		return nil
-	}
-	version, ok := getVersion(tx, uid)
-	if !ok {
-		return nil
-	}
-	todos := getTodos(tx, uid)
-	if todos == nil {
-		return nil
-	}
-	err = tx.Commit(context.Background())
-	if err != nil {
-		log.Printf("Failed to commit transaction: %v", err)
-		return nil
-	}
-	return &getTodosResp{
-		Version: version,
-		Todos:   todos,
-	}
+	return resp, e, ok
 }
 
-func (h *apiHandler) serveDeleteTodo(w http.ResponseWriter, r *deleteTodoRqst, uid string) {
-	h.serveMutateTodo(w, r.Version, r.ID, uid, &deleteOperation{id: r.ID, uid: uid})
+func (h *apiHandler) serveDeleteTodo(ctx context.Context, w http.ResponseWriter, r *deleteTodoRqst, uid string) {
+	h.serveMutateTodo(ctx, w, r.Version, r.ID, uid, r.ListID, r.syncOptions, &deleteOperation{id: r.ID})
 }
 
-func (h *apiHandler) serveUpdateTodo(w http.ResponseWriter, r *updateTodoRqst, uid string) {
-	h.serveMutateTodo(w, r.Version, r.ID, uid, &updateOperation{id: r.ID, uid: uid, value: r.Value})
+func (h *apiHandler) serveUpdateTodo(ctx context.Context, w http.ResponseWriter, r *updateTodoRqst, uid string) {
+	op := &updateOperation{id: r.ID, value: r.Value, attrs: r.todoAttrUpdate}
+	h.serveMutateTodo(ctx, w, r.Version, r.ID, uid, r.ListID, r.syncOptions, op)
 }
 
-func (h *apiHandler) serveMutateTodo(w http.ResponseWriter, version int32, id string, uid string, op execOperation) {
-	resp := h.txMutateTodo(version, id, uid, op)
-	if resp == "bad request" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if resp == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	writeJSON(w, resp)
+func (h *apiHandler) serveMoveTodo(ctx context.Context, w http.ResponseWriter, r *moveTodoRqst, uid string) {
+	op := &moveOperation{id: r.ID, before: r.Before, after: r.After}
+	h.serveMutateTodo(ctx, w, r.Version, r.ID, uid, r.ListID, r.syncOptions, op)
+}
+
+func (h *apiHandler) serveMutateTodo(ctx context.Context, w http.ResponseWriter, version int32, id string, uid string, listID string, opts syncOptions, op execOperation) {
+	writeResult(ctx, w, h.txMutateTodo(ctx, version, id, uid, listID, opts, op))
 }
 
 type execOperation interface {
-	// run must call tx.Exec and return the result.
-	run(tx pgx.Tx) (pgconn.CommandTag, error)
+	// run must call tx.Exec and return the result. listID is the ID of the
+	// list that the todo belongs to, and version is the todo list version that
+	// the mutation will produce.
+	run(ctx context.Context, tx pgx.Tx, listID string, version int32) (pgconn.CommandTag, error)
+	// conflict returns a todoConflict describing the client's side of the
+	// operation, or nil if the operation can't conflict with other changes.
+	conflict() *todoConflict
 }
 
 // txMutateTodo runs a transaction that mutates a particular todo. version and
 // id are the todo list version and todo ID in the request that initiated the
-// transaction. op is the operation (e.g. UPDATE, DELETE) to perform.
-// txMutateTodo returns a response struct if the transaction was successful,
-// "bad request" if the transaction failed due to a problem with the request, or
+// transaction, and listID identifies the user's list (see resolveList). opts
+// holds the client's choice of response format (see
+// versionMismatch). op is the operation (e.g. UPDATE, DELETE) to
+// perform.
+//
+// If version is stale, the operation is still carried out as long as no one
+// else changed the todo since version, and a versionMismatchResp (or
+// versionMismatchDeltaResp) with Merged set is returned so that the client can
+// catch up. Otherwise, the operation is rejected, and the mismatch response
+// describes the conflict.
+//
+// txMutateTodo returns a response struct if the transaction was successful, an
+// *errorResp if the transaction failed due to a problem with the request, or
 // nil if the transaction failed for some other reason.
-func (h *apiHandler) txMutateTodo(version int32, id string, uid string, op execOperation) any {
-	tx, err := h.pool.BeginTx(context.Background(), pgx.TxOptions{
-		IsoLevel:       pgx.Serializable,
-		AccessMode:     pgx.ReadWrite,
-		DeferrableMode: pgx.NotDeferrable,
+func (h *apiHandler) txMutateTodo(ctx context.Context, version int32, id string, uid string, listID string, opts syncOptions, op execOperation) (result any) {
+	h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		listID, e, ok := resolveList(ctx, tx, uid, listID, roleEditor)
+		if !ok {
+			return false
+		}
+		if e != nil {
+			result = e
+			return true
+		}
+		storedVersion, ok := getVersion(ctx, tx, listID)
+		if !ok {
+			return false
+		}
+		if version != storedVersion {
+			conflict, ok := checkConflict(ctx, tx, version, storedVersion, id, listID, op)
+			if !ok {
+				return false
+			}
+			if conflict != nil {
+				resp, ok := versionMismatch(ctx, tx, listID, version, storedVersion, opts,
+					mismatchDetails{Conflict: conflict})
+				if !ok {
+					return false
+				}
+				if err := tx.Commit(ctx); err != nil {
+					log.Printf("Failed to commit transaction: %v", err)
+					return false
+				}
+				versionMismatches.inc("conflict")
+				result = resp
+				return true
+			}
+		}
+		mutateResult := mutateTodo(ctx, tx, op, nextVersion(storedVersion), id, listID)
+		if mutateResult == "failure" {
+			return false
+		}
+		if mutateResult == "nonexistent" {
+			result = &errorResp{Code: "todoNotFound", Message: "the todo does not exist"}
+			return true
+		}
+		newVersion, ok := incrementVersion(ctx, tx, storedVersion, listID)
+		if !ok {
+			return false
+		}
+		_, reordered := op.(*moveOperation)
+		if !logChange(ctx, tx, listID, newVersion, id, reordered) {
+			return false
+		}
+		var resp any = &mutateTodoResp{Version: newVersion}
+		if version != storedVersion {
+			resp, ok = versionMismatch(ctx, tx, listID, version, newVersion, opts,
+				mismatchDetails{Merged: true})
+			if !ok {
+				return false
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return false
+		}
+		if version != storedVersion {
+			versionMismatches.inc("merged")
+		}
+		result = resp
+		return true
 	})
-	defer rollback(tx)
-	if err != nil {
-		log.Printf("Failed to start transaction: %v", err)
-		return nil
-	}
-	resp, ok := checkVersion(tx, uid, version)
-	if !ok {
-		return nil
-	}
-	if resp != nil {
-		return resp
-	}
-	mutateResult := mutateTodo(tx, op, id, uid)
-	if mutateResult == "failed" {
-		return nil
-	}
-	if mutateResult == "nonexistent" {
-		return "bad request"
-	}
-	newVersion, ok := incrementVersion(tx, version, uid)
-	if !ok {
-		return nil
+	return result
+}
+
+// checkConflict checks whether op conflicts with a change that another client
+// made to the todo with the given ID after clientVersion. storedVersion is the
+// current todo list version. checkConflict returns a description of the
+// conflict, or nil if there is none. If an error occurs, checkConflict logs
+// the error and sets ok to false.
+func checkConflict(ctx context.Context, tx pgx.Tx, clientVersion int32, storedVersion int32, id string, listID string, op execOperation) (conflict *todoConflict, ok bool) {
+	conflict = op.conflict()
+	if conflict == nil {
+		return nil, true
+	}
+	var todoVersion int32
+	var value string
+	query := "SELECT version, value FROM todos WHERE id = $1 AND list_id = $2"
+	err := tx.QueryRow(ctx, query, id, listID).Scan(&todoVersion, &value)
+	if err == pgx.ErrNoRows {
+		// Someone else deleted the todo (or it never existed).
+		conflict.ServerDeleted = true
+		return conflict, true
 	}
-	err = tx.Commit(context.Background())
 	if err != nil {
-		log.Printf("Failed to commit transaction: %v", err)
-		return nil
+		log.Printf("Failed to get version of todo with ID %v and list ID %v: %v", id, listID, err)
+		return nil, false
 	}
-	return &mutateTodoResp{Version: newVersion}
+	// If clientVersion is greater than storedVersion, then the list version
+	// wrapped around since the client's version, and todo versions can't be
+	// compared with it. Assume that there is a conflict.
+	if clientVersion < storedVersion && todoVersion <= clientVersion {
+		return nil, true
+	}
+	conflict.ServerValue = value
+	return conflict, true
 }
 
 // checkVersion checks for a mismatch between the given version and the stored
 // version. If ok == false, then an error occurred. Otherwise, resp holds the
-// response if a mismatch was detected, or nil if the versions match.
+// response if a mismatch was detected, or nil if the versions match. See
+// versionMismatch for the meaning of opts and the possible responses.
 //
 // If a mismatch is detected, checkVersion also attempts to commit tx.
-func checkVersion(tx pgx.Tx, uid string, version int32) (resp *versionMismatchResp, ok bool) {
-	storedVersion, ok := getVersion(tx, uid)
+func checkVersion(ctx context.Context, tx pgx.Tx, listID string, version int32, opts syncOptions) (resp any, ok bool) {
+	storedVersion, ok := getVersion(ctx, tx, listID)
 	if !ok {
 		return nil, false
 	}
 	if version != storedVersion {
-		log.Println("version mismatch")
-		todos := getTodos(tx, uid)
-		if todos == nil {
+		resp, ok := versionMismatch(ctx, tx, listID, version, storedVersion, opts, mismatchDetails{})
+		if !ok {
 			return nil, false
 		}
-		if err := tx.Commit(context.Background()); err != nil {
+		if err := tx.Commit(ctx); err != nil {
 			log.Printf("Failed to commit transaction: %v", err)
 			return nil, false
 		}
-		return &versionMismatchResp{
-			Version: storedVersion,
-			Todos:   todos,
-		}, true
+		versionMismatches.inc("stale")
+		return resp, true
 	}
 	return nil, true
 }
 
-func (h *apiHandler) serveAppendTodo(w http.ResponseWriter, r *appendTodoRqst, uid string) {
-	resp := h.txAppendTodo(r, uid)
-	if resp == "bad request" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if resp == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	writeJSON(w, resp)
+func (h *apiHandler) serveAppendTodo(ctx context.Context, w http.ResponseWriter, r *appendTodoRqst, uid string) {
+	writeResult(ctx, w, h.txAppendTodo(ctx, r, uid))
 }
 
-func (h *apiHandler) txAppendTodo(r *appendTodoRqst, uid string) any {
+// txAppendTodo runs a transaction that appends a todo to a list. It returns a
+// response struct if the transaction was successful, an *errorResp if the
+// transaction failed due to a problem with the request, or nil if the
+// transaction failed for some other reason.
+func (h *apiHandler) txAppendTodo(ctx context.Context, r *appendTodoRqst, uid string) (result any) {
 	// Note that we carry out the append operation even if the client's version
 	// doesn't match. This is considered safe; there is no way for an append to
 	// result in data loss, even if the client has a stale view.
-	tx, err := h.pool.BeginTx(context.Background(), pgx.TxOptions{
-		IsoLevel:       pgx.Serializable,
-		AccessMode:     pgx.ReadWrite,
-		DeferrableMode: pgx.NotDeferrable,
-	})
-	defer rollback(tx)
-	if err != nil {
-		log.Printf("Failed to start transaction: %v", err)
-		return nil
-	}
-	appendResult := appendTodo(tx, r.ID, uid)
-	if appendResult == "exists" {
-		return "bad request"
-	}
-	if appendResult == "failure" {
-		return nil
-	}
-	version, ok := getVersion(tx, uid)
-	if !ok {
-		return nil
-	}
-	newVersion, ok := incrementVersion(tx, version, uid)
-	if !ok {
-		return nil
-	}
-	if r.Version == version {
-		err = tx.Commit(context.Background())
-		if err != nil {
+	h.runTx(ctx, pgx.ReadWrite, func(tx pgx.Tx) bool {
+		listID, e, ok := resolveList(ctx, tx, uid, r.ListID, roleEditor)
+		if !ok {
+			return false
+		}
+		if e != nil {
+			result = e
+			return true
+		}
+		version, ok := getVersion(ctx, tx, listID)
+		if !ok {
+			return false
+		}
+		if e, ok := checkListSize(ctx, tx, listID, 1); e != nil || !ok {
+			result = e
+			return ok
+		}
+		op := &appendOperation{id: r.ID}
+		appendResult := mutateTodo(ctx, tx, op, nextVersion(version), r.ID, listID)
+		if appendResult == "exists" {
+			result = &errorResp{Code: "todoExists", Message: "a todo with the given ID already exists"}
+			return true
+		}
+		if appendResult != "success" {
+			return false
+		}
+		newVersion, ok := incrementVersion(ctx, tx, version, listID)
+		if !ok {
+			return false
+		}
+		if !logChange(ctx, tx, listID, newVersion, r.ID, false) {
+			return false
+		}
+		var resp any = &appendTodoResp{Version: newVersion}
+		if r.Version != version {
+			resp, ok = versionMismatch(ctx, tx, listID, r.Version, newVersion, r.syncOptions,
+				mismatchDetails{Merged: true})
+			if !ok {
+				return false
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
 			log.Printf("Failed to commit transaction: %v", err)
-			return nil
+			return false
 		}
-		return &appendTodoResp{
-			Version: newVersion,
+		if r.Version != version {
+			versionMismatches.inc("merged")
 		}
-	}
-	log.Println("version mismatch")
-	todos := getTodos(tx, uid)
-	if todos == nil {
-		return nil
-	}
-	err = tx.Commit(context.Background())
-	if err != nil {
-		log.Printf("Failed to commit transaction: %v", err)
-		return nil
-	}
-	return &versionMismatchResp{
-		Version: newVersion,
-		Todos:   todos,
-	}
+		result = resp
+		return true
+	})
+	return result
 }
 
-func (h *apiHandler) serveRefreshTodos(w http.ResponseWriter, r *refreshTodosRqst, uid string) {
-	resp, ok := h.txRefreshTodos(r, uid)
+func (h *apiHandler) serveRefreshTodos(ctx context.Context, w http.ResponseWriter, r *refreshTodosRqst, uid string) {
+	resp, ok := h.txRefreshTodos(ctx, r, uid)
 	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(ctx, w)
+		return
+	}
+	if e, ok := resp.(*errorResp); ok {
+		writeError(w, http.StatusBadRequest, e.Code, e.Message)
 		return
 	}
 	if resp == nil {
@@ -582,162 +796,325 @@ func (h *apiHandler) serveRefreshTodos(w http.ResponseWriter, r *refreshTodosRqs
 	writeJSON(w, resp)
 }
 
-func (h *apiHandler) txRefreshTodos(r *refreshTodosRqst, uid string) (resp *versionMismatchResp, ok bool) {
-	tx, err := h.pool.BeginTx(context.Background(), pgx.TxOptions{
-		IsoLevel:       pgx.Serializable,
-		AccessMode:     pgx.ReadOnly,
-		DeferrableMode: pgx.NotDeferrable,
+// txRefreshTodos runs a transaction that checks whether the client's version
+// of a list is up-to-date. See checkVersion for the meaning of the results. If
+// the list doesn't exist or the user isn't a member, resp is an *errorResp.
+func (h *apiHandler) txRefreshTodos(ctx context.Context, r *refreshTodosRqst, uid string) (resp any, ok bool) {
+	ok = h.runTx(ctx, pgx.ReadOnly, func(tx pgx.Tx) bool {
+		listID, e, ok := resolveList(ctx, tx, uid, r.ListID, roleViewer)
+		if !ok {
+			return false
+		}
+		if e != nil {
+			resp = e
+			return true
+		}
+		resp, ok = checkVersion(ctx, tx, listID, r.Version, r.syncOptions)
+		return ok
 	})
-	defer rollback(tx)
+	return resp, ok
+}
+
+type appendOperation struct {
+	id string
+}
+
+// run inserts the todo at the end of the list.
+func (a *appendOperation) run(ctx context.Context, tx pgx.Tx, listID string, version int32) (pgconn.CommandTag, error) {
+	var last *string
+	query := "SELECT max(position) FROM todos WHERE list_id = $1"
+	if err := tx.QueryRow(ctx, query, listID).Scan(&last); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	position, err := keyBetween(deref(last), "")
 	if err != nil {
-		log.Printf("Failed to start transaction: %v", err)
-		return nil, false
+		return pgconn.CommandTag{}, err
 	}
-	return checkVersion(tx, uid, r.Version)
+	return tx.Exec(ctx,
+		"INSERT INTO todos (id, list_id, value, version, position) VALUES ($1, $2, '', $3, $4)",
+		a.id, listID, version, position)
+}
+
+// conflict returns nil, since an append can't result in data loss even if the
+// client has a stale view.
+func (a *appendOperation) conflict() *todoConflict {
+	return nil
 }
 
 type deleteOperation struct {
-	id  string
-	uid string
+	id string
 }
 
-func (d *deleteOperation) run(tx pgx.Tx) (pgconn.CommandTag, error) {
-	return tx.Exec(context.Background(),
-		"DELETE FROM todos WHERE id = $1 AND user_id = $2", d.id, d.uid)
+func (d *deleteOperation) run(ctx context.Context, tx pgx.Tx, listID string, _ int32) (pgconn.CommandTag, error) {
+	return tx.Exec(ctx,
+		"DELETE FROM todos WHERE id = $1 AND list_id = $2", d.id, listID)
+}
+
+func (d *deleteOperation) conflict() *todoConflict {
+	return &todoConflict{ID: d.id, ClientDeleted: true}
 }
 
 type updateOperation struct {
 	id    string
-	uid   string
 	value string
+	attrs todoAttrUpdate
 }
 
-func (u *updateOperation) run(tx pgx.Tx) (pgconn.CommandTag, error) {
-	return tx.Exec(context.Background(),
-		"UPDATE todos SET value = $1 WHERE id = $2 AND user_id = $3",
-		u.value, u.id, u.uid)
+// run sets the todo's value, along with any attributes that are set in
+// u.attrs.
+func (u *updateOperation) run(ctx context.Context, tx pgx.Tx, listID string, version int32) (pgconn.CommandTag, error) {
+	var completed *bool
+	if u.attrs.Completed.Set {
+		completed = &u.attrs.Completed.Value
+	}
+	var priority *int32
+	if u.attrs.Priority.Set {
+		priority = &u.attrs.Priority.Value
+	}
+	cmd := `
+		UPDATE todos SET
+			value = $1,
+			version = $2,
+			completed_at = CASE
+				WHEN $5::boolean IS NULL THEN completed_at
+				WHEN $5 THEN coalesce(completed_at, CURRENT_TIMESTAMP)
+			END,
+			due_at = CASE WHEN $6 THEN $7 ELSE due_at END,
+			priority = coalesce($8, priority)
+		WHERE id = $3 AND list_id = $4`
+	return tx.Exec(ctx, cmd, u.value, version, u.id, listID,
+		completed, u.attrs.DueAt.Set, u.attrs.DueAt.Value, priority)
 }
 
-// mutateTodo attempts to mutate a todo (e.g. DELETE, UPDATE) by running op.
-// It returns "success" if the operation succeeded, "nonexistent" if the todo
-// doesn't exist, or "failure" if the operation failed for some other reason.
-// If the operation fails, mutateTodo logs the error.
-func mutateTodo(tx pgx.Tx, op execOperation, id string, uid string) string {
-	ct, err := op.run(tx)
+func (u *updateOperation) conflict() *todoConflict {
+	return &todoConflict{ID: u.id, ClientValue: u.value}
+}
+
+// moveOperation moves a todo so that it's immediately before or after another
+// todo (the anchor). Exactly one of before and after is set to the anchor's ID.
+type moveOperation struct {
+	id     string
+	before string
+	after  string
+}
+
+// run gives the todo a position between the anchor and the anchor's neighbor.
+// If the anchor doesn't exist, run doesn't change anything, so mutateTodo
+// reports that the todo doesn't exist. The todo's version is left alone, since
+// it records when the todo's value last changed (see checkConflict), and a
+// client that edits a todo that was moved since its version shouldn't get a
+// conflict.
+func (m *moveOperation) run(ctx context.Context, tx pgx.Tx, listID string, _ int32) (pgconn.CommandTag, error) {
+	anchor := m.before
+	if anchor == "" {
+		anchor = m.after
+	}
+	var anchorPosition string
+	query := "SELECT position FROM todos WHERE id = $1 AND list_id = $2"
+	err := tx.QueryRow(ctx, query, anchor, listID).Scan(&anchorPosition)
+	if err == pgx.ErrNoRows {
+		log.Printf("Failed to move todo with ID %v in list %v. Anchor %v does "+
+			"not exist.", m.id, listID, anchor)
+		return pgconn.CommandTag{}, nil
+	}
 	if err != nil {
-		log.Printf("Failed to mutate todo with ID %v and UID %v: %v",
-			id, uid, err)
-		return "failure"
+		return pgconn.CommandTag{}, err
 	}
-	rowsAffected := ct.RowsAffected()
-	if rowsAffected == 0 {
-		log.Printf("Failed to mutate todo with ID %v and UID %v. todo does "+
-			"not exist.", id, uid)
-		return "nonexistent"
+	// The neighbor is found while ignoring the todo being moved, since its
+	// current position is about to be vacated.
+	var neighbor *string
+	if m.before != "" {
+		query = "SELECT max(position) FROM todos WHERE list_id = $1 AND position < $2 AND id <> $3"
+	} else {
+		query = "SELECT min(position) FROM todos WHERE list_id = $1 AND position > $2 AND id <> $3"
 	}
-	if rowsAffected != 1 {
-		log.Printf("Failed to mutate todo with ID %v and UID %v. Unexpected number "+
-			"of rows affected (%v)", id, uid, rowsAffected)
-		return "failure"
+	err = tx.QueryRow(ctx, query, listID, anchorPosition, m.id).Scan(&neighbor)
+	if err != nil {
+		return pgconn.CommandTag{}, err
 	}
-	return "success"
+	var position string
+	if m.before != "" {
+		position, err = keyBetween(deref(neighbor), anchorPosition)
+	} else {
+		position, err = keyBetween(anchorPosition, deref(neighbor))
+	}
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return tx.Exec(ctx,
+		"UPDATE todos SET position = $1 WHERE id = $2 AND list_id = $3",
+		position, m.id, listID)
+}
+
+// conflict returns nil, since a move doesn't change the todo's value, so it
+// can't result in data loss even if the client has a stale view.
+func (m *moveOperation) conflict() *todoConflict {
+	return nil
+}
+
+// deref returns *s, or "" if s is nil.
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
 }
 
-// appendTodo creates a new todo with the given ID and user ID.
-// It returns "success" if the operation succeeded, "exists" if the todo already
+// mutateTodo attempts to mutate a todo (e.g. INSERT, DELETE, UPDATE) by
+// running op. version is the todo list version that the mutation will produce.
+// It returns "success" if the operation succeeded, "nonexistent" if the todo
+// doesn't exist, "exists" if the operation tried to create a todo that already
 // exists, or "failure" if the operation failed for some other reason.
-// If the operation fails, appendTodo logs the error.
-func appendTodo(tx pgx.Tx, id string, uid string) string {
-	cmd := "INSERT INTO todos (id, user_id, value) VALUES ($1, $2, '')"
-	ct, err := tx.Exec(context.Background(), cmd, id, uid)
+// If the operation fails, mutateTodo logs the error.
+func mutateTodo(ctx context.Context, tx pgx.Tx, op execOperation, version int32, id string, listID string) string {
+	ct, err := op.run(ctx, tx, listID, version)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
-			log.Printf("Failed to append todo with ID %v and UID %v. Todo already "+
-				"exists.", id, uid)
+			log.Printf("Failed to mutate todo with ID %v and list ID %v. Todo already "+
+				"exists.", id, listID)
 			return "exists"
 		}
-		log.Printf("Failed to append todo for UID %v: %v", uid, err)
+		log.Printf("Failed to mutate todo with ID %v and list ID %v: %v",
+			id, listID, err)
 		return "failure"
 	}
 	rowsAffected := ct.RowsAffected()
+	if rowsAffected == 0 {
+		log.Printf("Failed to mutate todo with ID %v and list ID %v. todo does "+
+			"not exist.", id, listID)
+		return "nonexistent"
+	}
 	if rowsAffected != 1 {
-		log.Printf("Failed to append todo for UID %v. Unexpected number "+
-			"of rows affected (%v)", uid, rowsAffected)
+		log.Printf("Failed to mutate todo with ID %v and list ID %v. Unexpected number "+
+			"of rows affected (%v)", id, listID, rowsAffected)
 		return "failure"
 	}
 	return "success"
 }
 
-// incrementVersion increments the todo list version for the user with the
-// given user ID.
+// incrementVersion increments the version of the todo list with the given ID.
 // tx is the transaction in which to perform the associated UPDATE.
 // v is the current todo list version.
-// uid is the user ID.
+// listID is the list ID.
+// incrementVersion also notifies other sessions of the change once tx commits.
 // incrementVersion returns the new v and a boolean indicating whether the
 // UPDATE command was successful. If the UPDATE fails, incrementVersion logs
 // the error.
-func incrementVersion(tx pgx.Tx, v int32, uid string) (int32, bool) {
-	if v == math.MaxInt32 {
-		v = 0
-	} else {
-		v++
-	}
-	ct, err := tx.Exec(context.Background(),
-		"UPDATE users SET version = $1 WHERE id = $2", v, uid)
+func incrementVersion(ctx context.Context, tx pgx.Tx, v int32, listID string) (int32, bool) {
+	v = nextVersion(v)
+	ct, err := tx.Exec(ctx,
+		"UPDATE lists SET version = $1 WHERE id = $2", v, listID)
 	if err != nil {
-		log.Printf("Failed to increment version for UID %v: %v", uid, err)
+		log.Printf("Failed to increment version for list ID %v: %v", listID, err)
 		return v, false
 	}
 	rowsAffected := ct.RowsAffected()
 	if rowsAffected != 1 {
-		log.Printf("Failed to increment version for UID %v. Unexpected number "+
-			"of rows affected (%v)", uid, rowsAffected)
+		log.Printf("Failed to increment version for list ID %v. Unexpected number "+
+			"of rows affected (%v)", listID, rowsAffected)
 		return v, false
 	}
-	return v, true
+	return v, notifyChange(ctx, tx, listID, v)
 }
 
-// getTodos gets the todos associated with the given user ID as a slice of
-// pairs, where the first element of each pair is the ID and the second element
-// is the value.
+// nextVersion returns the todo list version that follows v. Versions wrap
+// around to 0 rather than overflowing.
+func nextVersion(v int32) int32 {
+	if v == math.MaxInt32 {
+		return 0
+	}
+	return v + 1
+}
+
+// getTodos gets the todos in the list with the given ID, in list order.
 // If there are no such todos, getTodos returns an empty slice.
 // If an error occurs, getTodos logs the error and returns nil.
-func getTodos(tx pgx.Tx, uid string) [][2]string {
-	query := "SELECT id, value FROM todos WHERE user_id = $1 ORDER BY created"
-	rows, err := tx.Query(context.Background(), query, uid)
+func getTodos(ctx context.Context, tx pgx.Tx, listID string) []todo {
+	query := `
+		SELECT id, value, completed_at, due_at, priority FROM todos
+		WHERE list_id = $1 ORDER BY position`
+	rows, err := tx.Query(ctx, query, listID)
 	if err != nil {
-		log.Printf("Failed to get todos for UID \"%v\": %v", uid, err)
+		log.Printf("Failed to get todos for list ID \"%v\": %v", listID, err)
 		return nil
 	}
 	defer rows.Close()
-	var id, value string
-	todos, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) ([2]string, error) {
-		err := row.Scan(&id, &value)
-		return [2]string{id, value}, err
+	todos, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (todo, error) {
+		var t todo
+		err := row.Scan(&t.ID, &t.Value, &t.CompletedAt, &t.DueAt, &t.Priority)
+		t.Completed = t.CompletedAt != nil
+		return t, err
 	})
 	if err != nil {
 		log.Printf("Failed to iterate over query result while getting todos "+
-			"for UID \"%v\": %v", uid, err)
+			"for list ID \"%v\": %v", listID, err)
 		return nil
 	}
 	return todos
 }
 
-// getVersion gets the todo list version for the given user ID uid, returning
+// checkListSize checks that the list with the given ID has room for the given
+// number of new todos (see maxTodosPerList). If not, e describes the problem.
+// If an error occurs, checkListSize logs the error and sets ok to false.
+func checkListSize(ctx context.Context, tx pgx.Tx, listID string, appends int) (e *errorResp, ok bool) {
+	var n int
+	query := "SELECT count(*) FROM todos WHERE list_id = $1"
+	if err := tx.QueryRow(ctx, query, listID).Scan(&n); err != nil {
+		log.Printf("Failed to count todos for list ID %v: %v", listID, err)
+		return nil, false
+	}
+	if n+appends > maxTodosPerList {
+		return &errorResp{
+			Code:    "listFull",
+			Message: fmt.Sprintf("the list can't have more than %d todos", maxTodosPerList),
+		}, true
+	}
+	return nil, true
+}
+
+// getVersion gets the version of the todo list with the given ID, returning
 // the version and a boolean indicating whether the operation was successful.
 // If an error occurs, getVersion logs the error.
-func getVersion(tx pgx.Tx, uid string) (int32, bool) {
-	row := tx.QueryRow(context.Background(), "SELECT version FROM users WHERE id = $1", uid)
+func getVersion(ctx context.Context, tx pgx.Tx, listID string) (int32, bool) {
+	row := tx.QueryRow(ctx, "SELECT version FROM lists WHERE id = $1", listID)
 	var v int32
 	err := row.Scan(&v)
 	if err != nil {
-		log.Printf("Failed to get version for UID \"%v\": %v", uid, err)
+		log.Printf("Failed to get version for list ID \"%v\": %v", listID, err)
 		return v, false
 	}
 	return v, true
 }
 
+// writeResult writes the response for the result of a transaction that
+// returns a response struct if it was successful, an *errorResp if it failed
+// due to a problem with the request, or nil if it failed for some other reason.
+func writeResult(ctx context.Context, w http.ResponseWriter, resp any) {
+	if e, ok := resp.(*errorResp); ok {
+		writeError(w, http.StatusBadRequest, e.Code, e.Message)
+		return
+	}
+	if resp == nil {
+		writeServerError(ctx, w)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// writeServerError writes the response for a request that failed because of
+// an error, which has already been logged. If the request's deadline passed
+// (see opTimeouts), http.StatusServiceUnavailable is sent with the code
+// "timeout", so that the client can tell that retrying might succeed.
+// Otherwise, http.StatusInternalServerError is sent.
+func writeServerError(ctx context.Context, w http.ResponseWriter) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		writeError(w, http.StatusServiceUnavailable, "timeout", "the request took too long")
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
 func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
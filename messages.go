@@ -1,5 +1,19 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
 // This file contains type definitions used to marshal/unmarshal data via the
 // encoding/json package.
 // Fields must be exported in order for encoding/json to access them.
@@ -10,6 +24,11 @@ type loginRqst struct {
 	Password  string `json:"password"`
 }
 
+func (r *loginRqst) validate() error {
+	r.Username = normalizeUsername(r.Username)
+	return nil
+}
+
 type loginResp struct {
 	// true if login succeeded
 	// false if credentials invalid
@@ -21,6 +40,11 @@ type logoutRqst struct {
 	Operation string `json:"operation"`
 }
 
+// Logout-everywhere requests do not return any JSON.
+type logoutEverywhereRqst struct {
+	Operation string `json:"operation"`
+}
+
 type getUsernameRqst struct {
 	Operation string `json:"operation"`
 }
@@ -35,58 +59,657 @@ type createUserRqst struct {
 	Password  string `json:"password"`
 }
 
+func (r *createUserRqst) validate() error {
+	r.Username = normalizeUsername(r.Username)
+	if err := validateUsername(r.Username); err != nil {
+		return err
+	}
+	return validatePassword("password", r.Password)
+}
+
 type createUserResp struct {
 	// true if the username already exists
 	// false if the user was created and the client is now logged in
 	IsNameTaken bool `json:"isNameTaken"`
 }
 
+// deleteUserRqst deletes the logged in user's account. The password must be
+// sent again to confirm the deletion.
+type deleteUserRqst struct {
+	Operation string `json:"operation"`
+	Password  string `json:"password"`
+}
+
+type deleteUserResp struct {
+	// true if the account was deleted and the client is now logged out
+	// false if the password is incorrect
+	DidDelete bool `json:"didDelete"`
+}
+
+// changePasswordRqst changes the logged in user's password. The user's other
+// sessions are revoked, and the client is issued a new cookie.
+type changePasswordRqst struct {
+	Operation       string `json:"operation"`
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+func (r *changePasswordRqst) validate() error {
+	return validatePassword("newPassword", r.NewPassword)
+}
+
+type changePasswordResp struct {
+	// true if the password was changed
+	// false if the current password is incorrect
+	DidChange bool `json:"didChange"`
+}
+
+// Request-password-reset requests do not return any JSON. A password reset
+// token is sent to the user with the given username, if the user exists.
+type requestPasswordResetRqst struct {
+	Operation string `json:"operation"`
+	Username  string `json:"username"`
+}
+
+func (r *requestPasswordResetRqst) validate() error {
+	r.Username = normalizeUsername(r.Username)
+	return nil
+}
+
+// resetPasswordRqst sets a user's password using a token obtained with
+// requestPasswordResetRqst. The user's sessions are revoked.
+type resetPasswordRqst struct {
+	Operation   string `json:"operation"`
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+func (r *resetPasswordRqst) validate() error {
+	return validatePassword("newPassword", r.NewPassword)
+}
+
+type resetPasswordResp struct {
+	// true if the password was reset
+	// false if the token is invalid, has expired, or was already used
+	DidReset bool `json:"didReset"`
+}
+
 type getTodosRqst struct {
 	Operation string `json:"operation"`
+	listRef
+	// Structured indicates that the client accepts todo objects. See todoList.
+	Structured bool `json:"structured,omitempty"`
 }
 
 type getTodosResp struct {
-	Version int32       `json:"version"`
-	Todos   [][2]string `json:"todos"`
+	ListID  string   `json:"listId"`
+	Version int32    `json:"version"`
+	Todos   todoList `json:"todos"`
+}
+
+// listRef identifies the list that a request applies to. If ListID is omitted,
+// the request applies to the user's default list.
+type listRef struct {
+	ListID string `json:"listId,omitempty"`
+}
+
+func (r *listRef) validate() error {
+	if r.ListID == "" {
+		return nil
+	}
+	return validateListID(r.ListID)
+}
+
+type getListsRqst struct {
+	Operation string `json:"operation"`
+	// IncludeArchived indicates that archived lists should be included.
+	IncludeArchived bool `json:"includeArchived,omitempty"`
+}
+
+type getListsResp struct {
+	Lists []listInfo `json:"lists"`
+}
+
+type listInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Version int32  `json:"version"`
+	// Role is the user's role in the list: "owner", "editor", or "viewer".
+	Role string `json:"role"`
+	// Default is true for the list that requests without a list ID apply to.
+	Default  bool `json:"default"`
+	Archived bool `json:"archived"`
+}
+
+type createListRqst struct {
+	Operation string `json:"operation"`
+	Name      string `json:"name"`
+}
+
+func (r *createListRqst) validate() error {
+	return validateListName(r.Name)
+}
+
+// Rename-list requests do not return any JSON.
+type renameListRqst struct {
+	Operation string `json:"operation"`
+	ListID    string `json:"listId"`
+	Name      string `json:"name"`
+}
+
+func (r *renameListRqst) validate() error {
+	if err := validateListID(r.ListID); err != nil {
+		return err
+	}
+	return validateListName(r.Name)
+}
+
+// Archive-list requests do not return any JSON. Archived lists are left out of
+// getListsResp unless requested, but can otherwise be used as usual. The
+// default list can't be archived.
+type archiveListRqst struct {
+	Operation string `json:"operation"`
+	ListID    string `json:"listId"`
+	// Archived is false to unarchive the list.
+	Archived bool `json:"archived"`
+}
+
+func (r *archiveListRqst) validate() error {
+	return validateListID(r.ListID)
+}
+
+// Delete-list requests do not return any JSON. The list's todos are deleted
+// along with it. The default list can't be deleted.
+type deleteListRqst struct {
+	Operation string `json:"operation"`
+	ListID    string `json:"listId"`
+}
+
+func (r *deleteListRqst) validate() error {
+	return validateListID(r.ListID)
+}
+
+// Share-list requests do not return any JSON. They add the user with the
+// given username to the list, or change the user's role if they're already a
+// member. Only the owner can share a list.
+type shareListRqst struct {
+	Operation string `json:"operation"`
+	ListID    string `json:"listId"`
+	Username  string `json:"username"`
+	// Role is "editor" or "viewer".
+	Role string `json:"role"`
+}
+
+func (r *shareListRqst) validate() error {
+	if err := validateListID(r.ListID); err != nil {
+		return err
+	}
+	r.Username = normalizeUsername(r.Username)
+	if r.Username == "" {
+		return &fieldError{"username", "is empty"}
+	}
+	if r.Role != roleEditor && r.Role != roleViewer {
+		return &fieldError{"role", fmt.Sprintf("must be %q or %q", roleEditor, roleViewer)}
+	}
+	return nil
+}
+
+// Unshare-list requests do not return any JSON. They remove the user with the
+// given username from the list. The owner can remove any other member, and
+// members can remove themselves.
+type unshareListRqst struct {
+	Operation string `json:"operation"`
+	ListID    string `json:"listId"`
+	Username  string `json:"username"`
+}
+
+func (r *unshareListRqst) validate() error {
+	if err := validateListID(r.ListID); err != nil {
+		return err
+	}
+	r.Username = normalizeUsername(r.Username)
+	if r.Username == "" {
+		return &fieldError{"username", "is empty"}
+	}
+	return nil
+}
+
+type getListMembersRqst struct {
+	Operation string `json:"operation"`
+	ListID    string `json:"listId"`
+}
+
+func (r *getListMembersRqst) validate() error {
+	return validateListID(r.ListID)
+}
+
+type getListMembersResp struct {
+	Members []listMember `json:"members"`
+}
+
+type listMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// syncOptions holds the fields that clients use to choose the format of
+// responses that carry todos.
+type syncOptions struct {
+	// Delta indicates that the client accepts a versionMismatchDeltaResp.
+	Delta bool `json:"delta,omitempty"`
+	// Structured indicates that the client accepts todo objects. See todoList.
+	Structured bool `json:"structured,omitempty"`
+}
+
+// maxPriority is the highest todo priority. Priority 0 means none.
+const maxPriority = 3
+
+type todo struct {
+	ID          string     `json:"id"`
+	Value       string     `json:"value"`
+	Completed   bool       `json:"completed"`
+	CompletedAt *time.Time `json:"completedAt"`
+	DueAt       *time.Time `json:"dueAt"`
+	Priority    int32      `json:"priority"`
+}
+
+// todoList is encoded as an array of todo objects if structured is true.
+// Otherwise, it's encoded as an array of [id, value] pairs, which is the format
+// understood by clients that predate todo objects.
+type todoList struct {
+	todos      []todo
+	structured bool
+}
+
+func (l todoList) MarshalJSON() ([]byte, error) {
+	if l.structured {
+		if l.todos == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(l.todos)
+	}
+	pairs := make([][2]string, len(l.todos))
+	for i, t := range l.todos {
+		pairs[i] = [2]string{t.ID, t.Value}
+	}
+	return json.Marshal(pairs)
+}
+
+func (todoList) openAPISchema(g *schemaGenerator) any {
+	return map[string]any{"oneOf": []any{
+		g.schema(reflect.TypeOf([][2]string{})),
+		g.schema(reflect.TypeOf([]todo{})),
+	}}
+}
+
+// todoAttrUpdate holds the todo attributes that an update may change. Omitted
+// attributes are left unchanged.
+type todoAttrUpdate struct {
+	// Completing a todo that's already completed leaves completedAt unchanged.
+	Completed optional[bool] `json:"completed,omitempty"`
+	// A null dueAt clears the due date.
+	DueAt    optional[*time.Time] `json:"dueAt,omitempty"`
+	Priority optional[int32]      `json:"priority,omitempty"`
+}
+
+func (u *todoAttrUpdate) validate() error {
+	if u.Priority.Value < 0 || u.Priority.Value > maxPriority {
+		return &fieldError{"priority", fmt.Sprintf("must be between 0 and %d", maxPriority)}
+	}
+	return nil
+}
+
+// optional holds a request field that may be omitted. Set indicates whether
+// the field was present, which can't be determined from Value when the field
+// may be null.
+type optional[T any] struct {
+	Set   bool
+	Value T
+}
+
+func (o *optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	return json.Unmarshal(data, &o.Value)
+}
+
+func (optional[T]) openAPISchema(g *schemaGenerator) any {
+	return g.schema(reflect.TypeOf((*T)(nil)).Elem())
 }
 
 type deleteTodoRqst struct {
 	Operation string `json:"operation"`
-	Version   int32  `json:"version"`
-	ID        string `json:"id"`
+	listRef
+	Version int32  `json:"version"`
+	ID      string `json:"id"`
+	syncOptions
+}
+
+func (r *deleteTodoRqst) validate() error {
+	if err := r.listRef.validate(); err != nil {
+		return err
+	}
+	return validateTodoID(r.ID)
 }
 
 type updateTodoRqst struct {
 	Operation string `json:"operation"`
-	Version   int32  `json:"version"`
-	ID        string `json:"id"`
-	Value     string `json:"value"`
+	listRef
+	Version int32  `json:"version"`
+	ID      string `json:"id"`
+	Value   string `json:"value"`
+	todoAttrUpdate
+	syncOptions
+}
+
+func (r *updateTodoRqst) validate() error {
+	if err := r.listRef.validate(); err != nil {
+		return err
+	}
+	if err := validateTodoID(r.ID); err != nil {
+		return err
+	}
+	if err := validateTodoValue(r.Value); err != nil {
+		return err
+	}
+	return r.todoAttrUpdate.validate()
 }
 
-// This is the response type for both delete and update requests.
+// This is the response type for delete, update, and move requests.
 type mutateTodoResp struct {
 	Version int32 `json:"version"`
 }
 
 type appendTodoRqst struct {
 	Operation string `json:"operation"`
-	Version   int32  `json:"version"`
-	ID        string `json:"id"`
+	listRef
+	Version int32  `json:"version"`
+	ID      string `json:"id"`
+	syncOptions
+}
+
+func (r *appendTodoRqst) validate() error {
+	if err := r.listRef.validate(); err != nil {
+		return err
+	}
+	return validateTodoID(r.ID)
 }
 
 type appendTodoResp struct {
 	Version int32 `json:"version"`
 }
 
+// A move request places a todo immediately before or after another todo.
+// Exactly one of Before and After must be set to the other todo's ID.
+type moveTodoRqst struct {
+	Operation string `json:"operation"`
+	listRef
+	Version int32  `json:"version"`
+	ID      string `json:"id"`
+	Before  string `json:"before,omitempty"`
+	After   string `json:"after,omitempty"`
+	syncOptions
+}
+
+func (r *moveTodoRqst) validate() error {
+	if err := r.listRef.validate(); err != nil {
+		return err
+	}
+	if err := validateTodoID(r.ID); err != nil {
+		return err
+	}
+	anchor, field := r.Before, "before"
+	if r.After != "" {
+		anchor, field = r.After, "after"
+	}
+	if (r.Before == "") == (r.After == "") {
+		return errors.New("exactly one of fields \"before\" and \"after\" must be set")
+	}
+	if _, err := uuid.Parse(anchor); err != nil {
+		return &fieldError{field, "is not a UUID: " + err.Error()}
+	}
+	if anchor == r.ID {
+		return &fieldError{field, "must not equal field \"id\""}
+	}
+	return nil
+}
+
 // Refresh requests do not return any JSON if the client's todos are up-to-date.
 type refreshTodosRqst struct {
 	Operation string `json:"operation"`
-	Version   int32  `json:"version"`
+	listRef
+	Version int32 `json:"version"`
+	syncOptions
+}
+
+// A batch request applies a list of append, update, and delete operations,
+// all based on the same todo list version, in a single transaction.
+type batchRqst struct {
+	Operation string `json:"operation"`
+	listRef
+	Version int32     `json:"version"`
+	Ops     []batchOp `json:"ops"`
+	syncOptions
+}
+
+// batchOp is a single operation in a batch request. Op is "append",
+// "update", or "delete". Value and the todo attributes are only used by
+// updates, which require Value.
+type batchOp struct {
+	Op    string  `json:"op"`
+	ID    string  `json:"id"`
+	Value *string `json:"value,omitempty"`
+	todoAttrUpdate
+}
+
+func (r *batchRqst) validate() error {
+	if err := r.listRef.validate(); err != nil {
+		return err
+	}
+	if len(r.Ops) == 0 {
+		return &fieldError{"ops", "is empty"}
+	}
+	for i, o := range r.Ops {
+		if o.Op != "append" && o.Op != "update" && o.Op != "delete" {
+			return fmt.Errorf("ops[%d]: unknown op %q", i, o.Op)
+		}
+		if err := validateTodoID(o.ID); err != nil {
+			return fmt.Errorf("ops[%d]: %w", i, err)
+		}
+		if o.Op == "update" && o.Value == nil {
+			return fmt.Errorf("ops[%d]: %w", i, &fieldError{"value", "is required for updates"})
+		}
+		if o.Value != nil {
+			if err := validateTodoValue(*o.Value); err != nil {
+				return fmt.Errorf("ops[%d]: %w", i, err)
+			}
+		}
+		if err := o.todoAttrUpdate.validate(); err != nil {
+			return fmt.Errorf("ops[%d]: %w", i, err)
+		}
+	}
+	return nil
 }
 
-// This is an alternate response for delete, update, append, and refresh
-// requests.
+type batchResp struct {
+	Version int32 `json:"version"`
+}
+
+// This is an alternate response for delete, update, append, refresh, and
+// batch requests.
 type versionMismatchResp struct {
-	Version int32       `json:"version"`
-	Todos   [][2]string `json:"todos"`
+	Version int32    `json:"version"`
+	Todos   todoList `json:"todos"`
+	mismatchDetails
+}
+
+// This is sent instead of versionMismatchResp if the client sets Delta and the
+// server still has a record of every change since the client's version.
+// Changes holds the current state of every todo that changed, in list order.
+// The client should remove deleted todos, update the values of
+// todos that it has, and append the rest.
+type versionMismatchDeltaResp struct {
+	Version int32        `json:"version"`
+	Changes []todoChange `json:"changes"`
+	mismatchDetails
+}
+
+// mismatchDetails describes what happened to the change in a request that
+// was based on a stale version.
+type mismatchDetails struct {
+	// Merged is true if the change was applied anyway, because no one else
+	// changed the same todo. The todos in the response include the change.
+	Merged bool `json:"merged,omitempty"`
+	// Conflict is set if the change was rejected because someone else changed
+	// the same todo.
+	Conflict *todoConflict `json:"conflict,omitempty"`
+}
+
+// todoConflict holds both sides of a conflicting change to a todo.
+type todoConflict struct {
+	ID            string `json:"id"`
+	ClientValue   string `json:"clientValue"`
+	ClientDeleted bool   `json:"clientDeleted"`
+	ServerValue   string `json:"serverValue"`
+	ServerDeleted bool   `json:"serverDeleted"`
+}
+
+// todoChange holds the current state of a todo that changed. If Deleted is
+// true, only ID is set.
+type todoChange struct {
+	todo
+	Deleted bool `json:"deleted"`
+}
+
+// This is the request body for appending a todo through the REST API.
+type restNewTodo struct {
+	ID string `json:"id"`
+}
+
+func (r *restNewTodo) validate() error {
+	return validateTodoID(r.ID)
+}
+
+// This is the request body for updating a todo through the REST API.
+type restTodoUpdate struct {
+	Value string `json:"value"`
+	todoAttrUpdate
+}
+
+func (r *restTodoUpdate) validate() error {
+	if err := validateTodoValue(r.Value); err != nil {
+		return err
+	}
+	return r.todoAttrUpdate.validate()
+}
+
+// This is the response for requests that are rejected by the server. Code is
+// a machine-readable identifier for the problem (e.g. "missingField"), and
+// Message is a human-readable description. Field names the request field that
+// is invalid, if the problem is with a single field, so that clients can show
+// the message next to the corresponding input.
+type errorResp struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+// fieldError is a validation error for a single request field.
+type fieldError struct {
+	field  string
+	reason string
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("field %q %v", e.field, e.reason)
+}
+
+const (
+	// maxUsernameLength is the maximum number of characters in a username.
+	maxUsernameLength = 30
+	// minPasswordLength is the minimum number of characters in a password.
+	minPasswordLength = 8
+	// maxPasswordLength is the maximum number of bytes in a password. bcrypt
+	// can't hash longer passwords.
+	maxPasswordLength = 72
+	// maxTodoLength is the maximum number of characters in a todo value.
+	maxTodoLength = 1000
+	// maxTodosPerList is the maximum number of todos in a list.
+	maxTodosPerList = 10000
+)
+
+// normalizeUsername returns the NFC normal form of name, so that a username
+// that can be encoded in several ways refers to the same user however it was
+// typed.
+func normalizeUsername(name string) string {
+	return norm.NFC.String(name)
+}
+
+// validateUsername checks that a normalized username isn't empty or too long,
+// and only consists of letters, digits, and the characters "_", "-", and ".".
+func validateUsername(name string) error {
+	if name == "" {
+		return &fieldError{"username", "is empty"}
+	}
+	if utf8.RuneCountInString(name) > maxUsernameLength {
+		return &fieldError{"username", fmt.Sprintf("is longer than %d characters", maxUsernameLength)}
+	}
+	for _, r := range name {
+		if !unicode.In(r, unicode.Letter, unicode.Mark, unicode.Digit) && !strings.ContainsRune("_-.", r) {
+			return &fieldError{"username", fmt.Sprintf("contains the character %q, which isn't "+
+				"a letter, a digit, \"_\", \"-\", or \".\"", r)}
+		}
+	}
+	return nil
+}
+
+// validatePassword checks the length of a new password, which is held in the
+// given request field.
+func validatePassword(field string, pwd string) error {
+	if utf8.RuneCountInString(pwd) < minPasswordLength {
+		return &fieldError{field, fmt.Sprintf("is shorter than %d characters", minPasswordLength)}
+	}
+	if len(pwd) > maxPasswordLength {
+		return &fieldError{field, fmt.Sprintf("is longer than %d bytes", maxPasswordLength)}
+	}
+	return nil
+}
+
+// validateTodoValue checks that a todo value isn't too long.
+func validateTodoValue(value string) error {
+	if utf8.RuneCountInString(value) > maxTodoLength {
+		return &fieldError{"value", fmt.Sprintf("is longer than %d characters", maxTodoLength)}
+	}
+	return nil
+}
+
+// maxListNameLength is the maximum number of characters in a list name.
+const maxListNameLength = 100
+
+// validateListID checks that id is a UUID, which is the type of list IDs in
+// the database.
+func validateListID(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return &fieldError{"listId", "is not a UUID: " + err.Error()}
+	}
+	return nil
+}
+
+// validateListName checks that name isn't blank or too long.
+func validateListName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return &fieldError{"name", "is blank"}
+	}
+	if utf8.RuneCountInString(name) > maxListNameLength {
+		return &fieldError{"name", fmt.Sprintf("is longer than %d characters", maxListNameLength)}
+	}
+	return nil
+}
+
+// validateTodoID checks that id is a UUID, which is the type of todo IDs in
+// the database.
+func validateTodoID(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return &fieldError{"id", "is not a UUID: " + err.Error()}
+	}
+	return nil
 }
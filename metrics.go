@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are served at /metrics in the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/).
+
+// A metric writes its samples in the text exposition format.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// allMetrics holds every metric, in the order in which they are served.
+var allMetrics []metric
+
+// counterVec is a counter with one value per combination of label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	// values maps the formatted label pairs (see formatLabels) to values.
+	values map[string]float64
+}
+
+// newCounterVec creates and registers a counter with the given labels.
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	allMetrics = append(allMetrics, c)
+	return c
+}
+
+// inc increments the value for the given label values, which correspond to
+// c.labels.
+func (c *counterVec) inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, k, c.values[k])
+	}
+	c.mu.Unlock()
+}
+
+// histogramVec is a histogram with one set of buckets per combination of
+// label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	// values maps the label values, joined by labelSep, to histograms.
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	// counts holds the number of observations in each bucket, not including
+	// smaller buckets.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// labelSep separates label values in the keys of histogramVec.values. It
+// can't occur in valid UTF-8.
+const labelSep = "\xff"
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of a
+// histogram of request durations.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// newHistogramVec creates and registers a histogram with the given bucket
+// upper bounds, in increasing order, and labels.
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	allMetrics = append(allMetrics, h)
+	return h
+}
+
+// observe records v for the given label values, which correspond to h.labels.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist := h.values[key]
+	if hist == nil {
+		hist = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(h.labels[:len(h.labels):len(h.labels)], "le")
+	for _, k := range keys {
+		hist := h.values[k]
+		bucketValues := append(hist.labelValues[:len(hist.labelValues):len(hist.labelValues)], "")
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += hist.counts[i]
+			bucketValues[len(bucketValues)-1] = fmt.Sprint(b)
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(bucketLabels, bucketValues), cumulative)
+		}
+		bucketValues[len(bucketValues)-1] = "+Inf"
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(bucketLabels, bucketValues), hist.count)
+		labels := formatLabels(h.labels, hist.labelValues)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, labels, hist.sum)
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, labels, hist.count)
+	}
+	h.mu.Unlock()
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, typ)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// formatLabels returns the label pairs with the given names and values, e.g.
+// {sqlstate="40001"}, or "" if there are no labels.
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%v="%v"`, name, labelEscaper.Replace(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	requests = newCounterVec("todo_requests_total",
+		"API requests, by operation and HTTP status code.", "operation", "status")
+	requestDuration = newHistogramVec("todo_request_duration_seconds",
+		"How long API requests took, by operation.", durationBuckets, "operation")
+)
+
+// statusRecorder remembers the status code of the response written through
+// it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// recordRequest returns a ResponseWriter that wraps w, and a function that
+// must be called once the response for the given operation has been written
+// to record it in the requests and requestDuration metrics.
+func recordRequest(w http.ResponseWriter, op string) (http.ResponseWriter, func()) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() {
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requests.inc(op, fmt.Sprint(status))
+		requestDuration.observe(time.Since(start).Seconds(), op)
+	}
+}
+
+// poolMetrics reports the state of a database connection pool. Most of it
+// comes from pgxpool, except for the number of waiting callers, which dbPool
+// counts.
+type poolMetrics struct {
+	pool *dbPool
+}
+
+// registerPoolMetrics registers metrics for the given pool.
+func registerPoolMetrics(pool *dbPool) {
+	allMetrics = append(allMetrics, &poolMetrics{pool})
+}
+
+func (m *poolMetrics) write(w *bufio.Writer) {
+	s := m.pool.Stat()
+	writeSample(w, "todo_db_pool_acquired_connections",
+		"Connections that are in use.", "gauge", s.AcquiredConns())
+	writeSample(w, "todo_db_pool_idle_connections",
+		"Connections that are ready to be used.", "gauge", s.IdleConns())
+	writeSample(w, "todo_db_pool_constructing_connections",
+		"Connections that are being opened.", "gauge", s.ConstructingConns())
+	writeSample(w, "todo_db_pool_max_connections",
+		"The maximum number of connections.", "gauge", s.MaxConns())
+	writeSample(w, "todo_db_pool_waiting",
+		"Callers that are waiting to acquire a connection.", "gauge", m.pool.waiting.Load())
+	writeSample(w, "todo_db_pool_acquires_total",
+		"Connections acquired from the pool.", "counter", s.AcquireCount())
+	writeSample(w, "todo_db_pool_empty_acquires_total",
+		"Connections acquired after waiting because none were idle.", "counter", s.EmptyAcquireCount())
+	writeSample(w, "todo_db_pool_canceled_acquires_total",
+		"Attempts to acquire a connection that were canceled while waiting.", "counter", s.CanceledAcquireCount())
+	writeSample(w, "todo_db_pool_acquire_duration_seconds_total",
+		"Time spent acquiring connections.", "counter", s.AcquireDuration().Seconds())
+}
+
+// writeSample writes a metric with a single unlabeled sample.
+func writeSample(w *bufio.Writer, name string, help string, typ string, v any) {
+	writeHeader(w, name, help, typ)
+	fmt.Fprintf(w, "%v %v\n", name, v)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range allMetrics {
+		m.write(bw)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The database schema is defined by the SQL migrations in the migrations
+// directory, which are embedded in the binary. Each migration is named
+// <version>_<name>.up.sql, and may have a matching .down.sql file that undoes
+// it. Migrations without a down file are irreversible. The versions of the
+// applied migrations are recorded in the schema_migrations table.
+//
+// The server applies pending migrations on startup. Since several instances
+// may start at once, migrations run while holding a PostgreSQL advisory lock,
+// so that only one instance applies them and the others wait for it to finish.
+//
+// Databases that were created before migrations were introduced have tables
+// but no migration history. If their schema is the initial one, migration 1
+// is recorded as applied, and the rest are applied as usual. Otherwise, the
+// migrations that were applied by hand must be recorded with the baseline
+// command.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID identifies the advisory lock held while migrating.
+const migrationLockID = 0x746f646f // "todo"
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	// down is "" if the migration is irreversible.
+	down string
+}
+
+// loadMigrations returns the embedded migrations, ordered by version.
+func loadMigrations() ([]migration, error) {
+	paths, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, path := range paths {
+		base := strings.TrimPrefix(path, "migrations/")
+		stem, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("malformed migration file name %q", base)
+		}
+		v, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(v)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("malformed migration file name %q", base)
+		}
+		sql, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		} else if m.name != name {
+			return nil, fmt.Errorf("migrations %q and %q have the same version", m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(sql)
+		} else {
+			m.down = string(sql)
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %v (%v) has no up file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %v is missing", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+var errNoMigrationHistory = errors.New("the database has tables but no migration history; " +
+	"record the migrations that were applied by hand with the baseline command")
+
+// migrate migrates the schema in the given direction, "up" or "down", until
+// it is at the target version. migrate returns an error if the target is in
+// the other direction. Each migration runs in its own transaction. If dryRun
+// is true, migrate writes the SQL that it would execute to standard output
+// instead of executing it, and doesn't write to the database at all.
+func migrate(ctx context.Context, pool *pgxpool.Pool, migrations []migration, target int, direction string, dryRun bool) error {
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("no migration has version %v", target)
+	}
+	if dryRun {
+		current, hasHistory, err := readSchemaVersion(ctx, pool)
+		if errors.Is(err, errNoMigrationHistory) {
+			current, err = readInitialSchema(ctx, pool)
+			if err == nil {
+				fmt.Println("-- The initial schema would be recorded as migration 1.")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if !hasHistory {
+			fmt.Println("-- The schema_migrations table doesn't exist yet, and would be created.")
+		}
+		return planMigrations(migrations, current, target, direction,
+			func(m migration, direction string, sql string) error {
+				fmt.Printf("-- %04d_%v.%v.sql\n%v\n", m.version, m.name, direction, sql)
+				return nil
+			})
+	}
+	return withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		current, err := schemaVersion(ctx, conn)
+		if errors.Is(err, errNoMigrationHistory) {
+			current, err = baselineInitialSchema(ctx, conn)
+		}
+		if err != nil {
+			return err
+		}
+		return planMigrations(migrations, current, target, direction,
+			func(m migration, direction string, sql string) error {
+				return runMigration(ctx, conn, m.version, m.name, direction, sql)
+			})
+	})
+}
+
+// planMigrations calls run for each migration that takes the schema from the
+// current version to the target version in the given direction, in order,
+// with the direction and SQL to run. It returns an error if the target is in
+// the other direction, or if a migration is irreversible.
+func planMigrations(migrations []migration, current int, target int, direction string, run func(m migration, direction string, sql string) error) error {
+	if current > len(migrations) {
+		log.Printf("The schema version (%v) is newer than the latest migration (%v)",
+			current, len(migrations))
+		return nil
+	}
+	if direction == "up" && target < current {
+		return fmt.Errorf("the schema version (%v) is above the target (%v); use down to revert migrations",
+			current, target)
+	}
+	if direction == "down" && target > current {
+		return fmt.Errorf("the schema version (%v) is below the target (%v); use up to apply migrations",
+			current, target)
+	}
+	if direction == "up" {
+		for _, m := range migrations[current:target] {
+			if err := run(m, "up", m.up); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := current - 1; i >= target; i-- {
+		m := migrations[i]
+		if m.down == "" {
+			return fmt.Errorf("migration %v (%v) is irreversible", m.version, m.name)
+		}
+		if err := run(m, "down", m.down); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMigration executes sql, which migrates the schema in the given direction,
+// and records the result in schema_migrations.
+func runMigration(ctx context.Context, conn *pgxpool.Conn, version int, name string, direction string, sql string) error {
+	log.Printf("Migrating %v: %v (%v)", direction, version, name)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("migration %v (%v) failed: %w", version, name, err)
+	}
+	cmd := "INSERT INTO schema_migrations (version) VALUES ($1)"
+	if direction == "down" {
+		cmd = "DELETE FROM schema_migrations WHERE version = $1"
+	}
+	if _, err := tx.Exec(ctx, cmd, version); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// baseline records migrations 1 through version as applied without running
+// them. It is used for databases whose schema was created or migrated by hand
+// before migrations were introduced.
+func baseline(ctx context.Context, pool *pgxpool.Pool, migrations []migration, version int) error {
+	if version < 1 || version > len(migrations) {
+		return fmt.Errorf("no migration has version %v", version)
+	}
+	return withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		var n int
+		if err := conn.QueryRow(ctx, "SELECT count(*) FROM schema_migrations").Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return errors.New("the migration history isn't empty")
+		}
+		cmd := "INSERT INTO schema_migrations (version) SELECT generate_series(1, $1::int)"
+		_, err := conn.Exec(ctx, cmd, version)
+		return err
+	})
+}
+
+// initialSchema lists the columns of the tables created by migration 1, which
+// is the schema that databases had before migrations were introduced, as
+// "<table>.<column> <type>", in order.
+var initialSchema = []string{
+	"todos.created timestamp with time zone",
+	"todos.id uuid",
+	"todos.user_id uuid",
+	"todos.value text",
+	"users.id uuid",
+	"users.name character varying",
+	"users.password character varying",
+	"users.version integer",
+}
+
+// hasInitialSchema returns whether the database's tables, other than
+// schema_migrations, are exactly those created by migration 1.
+func hasInitialSchema(ctx context.Context, conn *pgxpool.Conn) (bool, error) {
+	query := `
+		SELECT table_name || '.' || column_name || ' ' || data_type
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'
+		ORDER BY table_name, column_name`
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	columns, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return false, err
+	}
+	if len(columns) != len(initialSchema) {
+		return false, nil
+	}
+	for i, c := range columns {
+		if c != initialSchema[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// baselineInitialSchema records migration 1 as applied if the database has
+// the initial schema but no migration history, and returns the resulting
+// schema version. It returns errNoMigrationHistory if the schema is another
+// one. The caller must hold the migration lock.
+func baselineInitialSchema(ctx context.Context, conn *pgxpool.Conn) (int, error) {
+	initial, err := hasInitialSchema(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if !initial {
+		return 0, errNoMigrationHistory
+	}
+	log.Println("The database has the initial schema but no migration history; recording migration 1 as applied")
+	if _, err := conn.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES (1)"); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// readInitialSchema returns the schema version that baselineInitialSchema
+// would record, without writing to the database.
+func readInitialSchema(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	initial, err := hasInitialSchema(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if !initial {
+		return 0, errNoMigrationHistory
+	}
+	return 1, nil
+}
+
+// withMigrationLock acquires a connection, holds the migration lock on it,
+// creates the schema_migrations table if it doesn't exist, and calls f.
+func withMigrationLock(ctx context.Context, pool *pgxpool.Pool, f func(conn *pgxpool.Conn) error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer func() {
+		_, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+		if err != nil {
+			log.Printf("Failed to release migration lock: %v", err)
+		}
+	}()
+	cmd := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version int PRIMARY KEY,
+			applied timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`
+	if _, err := conn.Exec(ctx, cmd); err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+// schemaVersion returns the version of the latest applied migration, or 0 if
+// none have been applied. It returns errNoMigrationHistory if no migrations
+// have been applied but the database already has tables.
+func schemaVersion(ctx context.Context, conn *pgxpool.Conn) (int, error) {
+	var version int
+	query := "SELECT coalesce(max(version), 0) FROM schema_migrations"
+	if err := conn.QueryRow(ctx, query).Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > 0 {
+		return version, nil
+	}
+	var exists bool
+	query = "SELECT to_regclass('users') IS NOT NULL"
+	if err := conn.QueryRow(ctx, query).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, errNoMigrationHistory
+	}
+	return 0, nil
+}
+
+// readSchemaVersion returns the schema version (see schemaVersion) without
+// writing to the database. hasHistory is false if the schema_migrations table
+// doesn't exist yet, in which case the version is 0.
+func readSchemaVersion(ctx context.Context, pool *pgxpool.Pool) (version int, hasHistory bool, err error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Release()
+	query := "SELECT to_regclass('schema_migrations') IS NOT NULL"
+	if err := conn.QueryRow(ctx, query).Scan(&hasHistory); err != nil {
+		return 0, false, err
+	}
+	if !hasHistory {
+		query = "SELECT to_regclass('users') IS NOT NULL"
+		var exists bool
+		if err := conn.QueryRow(ctx, query).Scan(&exists); err != nil {
+			return 0, false, err
+		}
+		if exists {
+			return 0, false, errNoMigrationHistory
+		}
+		return 0, false, nil
+	}
+	version, err = schemaVersion(ctx, conn)
+	return version, true, err
+}
+
+// runMigrateCommand implements the migrate subcommand, whose usage is
+//
+//	server migrate [up|down|status|baseline] [-to version] [-dry-run]
+//
+// up (the default) applies migrations up to the given version, or all of them
+// if -to is omitted. down reverts migrations down to the given version, which
+// is required. Neither migrates in the other direction. status prints the
+// schema version. -dry-run and status don't write to the database. baseline
+// records migrations up to the given version as applied without running
+// them.
+func runMigrateCommand(args []string) {
+	command := "up"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := flags.Int("to", -1, "the target schema version")
+	dryRun := flags.Bool("dry-run", false, "print the SQL instead of executing it")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	pool := connectDB()
+	defer pool.Close()
+	ctx := context.Background()
+	switch command {
+	case "up":
+		if *to < 0 {
+			*to = len(migrations)
+		}
+		err = migrate(ctx, pool, migrations, *to, "up", *dryRun)
+	case "down":
+		if *to < 0 {
+			log.Fatal("down requires -to")
+		}
+		err = migrate(ctx, pool, migrations, *to, "down", *dryRun)
+	case "status":
+		var version int
+		version, _, err = readSchemaVersion(ctx, pool)
+		if err == nil {
+			fmt.Printf("Schema version %v of %v\n", version, len(migrations))
+		}
+	case "baseline":
+		if *dryRun {
+			log.Fatal("baseline doesn't support -dry-run")
+		}
+		err = baseline(ctx, pool, migrations, *to)
+	default:
+		log.Fatalf("Unknown migrate command %q", command)
+	}
+	if err != nil {
+		pool.Close()
+		log.Fatalf("Failed to migrate: %v", err)
+	}
+}
+
+// connectDB creates a connection pool for the database at DB_URL. It exits
+// the program if DB_URL isn't set or is invalid.
+func connectDB() *pgxpool.Pool {
+	dbURL, ok := os.LookupEnv("DB_URL")
+	if !ok {
+		log.Fatal("DB_URL not set")
+	}
+	pool, err := pgxpool.New(context.Background(), dbURL)
+	if err != nil {
+		log.Fatalf("Failed to create database connection pool: %v\n", err)
+	}
+	return pool
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPlanMigrations(t *testing.T) {
+	migrations := []migration{
+		{version: 1, name: "a", up: "up 1", down: "down 1"},
+		{version: 2, name: "b", up: "up 2", down: "down 2"},
+		{version: 3, name: "c", up: "up 3", down: "down 3"},
+	}
+	tests := []struct {
+		current   int
+		target    int
+		direction string
+		want      []string // nil if an error is expected
+	}{
+		{0, 3, "up", []string{"up 1", "up 2", "up 3"}},
+		{1, 2, "up", []string{"up 2"}},
+		{2, 2, "up", []string{}},
+		{3, 1, "down", []string{"down 3", "down 2"}},
+		{2, 2, "down", []string{}},
+		// The target is in the other direction.
+		{3, 1, "up", nil},
+		{1, 3, "down", nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v %v to %v", tt.direction, tt.current, tt.target), func(t *testing.T) {
+			got := []string{}
+			err := planMigrations(migrations, tt.current, tt.target, tt.direction,
+				func(m migration, direction string, sql string) error {
+					got = append(got, sql)
+					return nil
+				})
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				if len(got) > 0 {
+					t.Errorf("ran %v before failing", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+CREATE TABLE users (
+  id       uuid PRIMARY KEY,
+  name     varchar(30) UNIQUE NOT NULL,
+  password varchar(50) NOT NULL,
+  version  int NOT NULL CHECK (version >= 0)
+);
+
+CREATE TABLE todos (
+  id      uuid PRIMARY KEY,
+  user_id uuid NOT NULL REFERENCES users (id),
+  value   text NOT NULL,
+  created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+-- Existing plaintext passwords are hashed the next time each user logs in.
+-- There is no down migration, since the hashes don't fit in the old column.
+ALTER TABLE users ALTER COLUMN password TYPE text;
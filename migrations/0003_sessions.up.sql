@@ -0,0 +1,6 @@
+-- Users who were logged in beforehand will need to log in again.
+CREATE TABLE sessions (
+  id      uuid PRIMARY KEY,
+  user_id uuid NOT NULL REFERENCES users (id),
+  expires timestamptz NOT NULL
+);
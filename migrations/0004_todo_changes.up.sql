@@ -0,0 +1,7 @@
+CREATE TABLE todo_changes (
+  user_id uuid NOT NULL REFERENCES users (id),
+  version int NOT NULL,
+  todo_id uuid NOT NULL
+);
+
+CREATE INDEX ON todo_changes (user_id, version);
@@ -0,0 +1,4 @@
+-- version is the todo list version in which the todo last changed.
+ALTER TABLE todos ADD COLUMN version int CHECK (version >= 0);
+UPDATE todos t SET version = u.version FROM users u WHERE t.user_id = u.id;
+ALTER TABLE todos ALTER COLUMN version SET NOT NULL;
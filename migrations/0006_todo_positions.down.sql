@@ -0,0 +1,2 @@
+ALTER TABLE todo_changes DROP COLUMN reordered;
+ALTER TABLE todos DROP COLUMN position;
@@ -0,0 +1,12 @@
+-- position is a fractional index that determines the todo's place in the list
+-- (see rank.go). It must be compared bytewise. Existing todos keep their
+-- creation order.
+ALTER TABLE todos ADD COLUMN position text COLLATE "C";
+UPDATE todos t SET position = 'a0' || lpad(p.n::text, 10, '0') || 'V'
+  FROM (SELECT id, row_number() OVER (PARTITION BY user_id ORDER BY created) AS n FROM todos) p
+  WHERE t.id = p.id;
+ALTER TABLE todos ALTER COLUMN position SET NOT NULL;
+CREATE INDEX ON todos (user_id, position);
+
+-- reordered indicates that the change moved the todo within the list.
+ALTER TABLE todo_changes ADD COLUMN reordered boolean NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+ALTER TABLE todos DROP COLUMN priority;
+ALTER TABLE todos DROP COLUMN due_at;
+ALTER TABLE todos DROP COLUMN completed_at;
@@ -0,0 +1,5 @@
+-- completed_at is null if the todo isn't completed.
+ALTER TABLE todos ADD COLUMN completed_at timestamptz;
+ALTER TABLE todos ADD COLUMN due_at timestamptz;
+-- priority ranges from 0 (none) to 3 (high). See maxPriority.
+ALTER TABLE todos ADD COLUMN priority int NOT NULL DEFAULT 0 CHECK (priority BETWEEN 0 AND 3);
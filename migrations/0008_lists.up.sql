@@ -0,0 +1,32 @@
+-- Each user's todos move into a default list, which takes over the user's
+-- version. There is no down migration, since users may have created more
+-- lists since.
+CREATE TABLE lists (
+  id         uuid PRIMARY KEY,
+  user_id    uuid NOT NULL REFERENCES users (id),
+  name       varchar(100) NOT NULL,
+  version    int NOT NULL CHECK (version >= 0),
+  -- Each user has exactly one default list.
+  is_default boolean NOT NULL DEFAULT false,
+  archived   boolean NOT NULL DEFAULT false,
+  created    timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX ON lists (user_id) WHERE is_default;
+
+INSERT INTO lists (id, user_id, name, version, is_default)
+  SELECT gen_random_uuid(), id, 'Todos', version, true FROM users;
+
+ALTER TABLE todos ADD COLUMN list_id uuid REFERENCES lists (id);
+UPDATE todos t SET list_id = l.id FROM lists l WHERE l.user_id = t.user_id;
+ALTER TABLE todos ALTER COLUMN list_id SET NOT NULL;
+ALTER TABLE todos DROP COLUMN user_id;
+CREATE INDEX ON todos (list_id, position);
+
+ALTER TABLE todo_changes ADD COLUMN list_id uuid REFERENCES lists (id);
+UPDATE todo_changes c SET list_id = l.id FROM lists l WHERE l.user_id = c.user_id;
+ALTER TABLE todo_changes ALTER COLUMN list_id SET NOT NULL;
+ALTER TABLE todo_changes DROP COLUMN user_id;
+CREATE INDEX ON todo_changes (list_id, version);
+
+ALTER TABLE users DROP COLUMN version;
@@ -0,0 +1,9 @@
+-- Members other than the owner lose access to the list.
+ALTER TABLE lists ADD COLUMN user_id uuid REFERENCES users (id);
+ALTER TABLE lists ADD COLUMN is_default boolean NOT NULL DEFAULT false;
+UPDATE lists l SET user_id = m.user_id, is_default = m.is_default
+  FROM list_members m WHERE m.list_id = l.id AND m.role = 'owner';
+ALTER TABLE lists ALTER COLUMN user_id SET NOT NULL;
+CREATE UNIQUE INDEX ON lists (user_id) WHERE is_default;
+
+DROP TABLE list_members;
@@ -0,0 +1,17 @@
+-- Each list's user becomes its owner.
+CREATE TABLE list_members (
+  list_id    uuid NOT NULL REFERENCES lists (id),
+  user_id    uuid NOT NULL REFERENCES users (id),
+  role       text NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+  -- Each user has exactly one default list, which they own.
+  is_default boolean NOT NULL DEFAULT false,
+  PRIMARY KEY (list_id, user_id)
+);
+
+CREATE UNIQUE INDEX ON list_members (user_id) WHERE is_default;
+
+INSERT INTO list_members (list_id, user_id, role, is_default)
+  SELECT id, user_id, 'owner', is_default FROM lists;
+
+ALTER TABLE lists DROP COLUMN user_id;
+ALTER TABLE lists DROP COLUMN is_default;
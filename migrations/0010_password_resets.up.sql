@@ -0,0 +1,9 @@
+CREATE TABLE password_resets (
+  -- token_hash is the SHA-256 hash of the reset token, so that the tokens
+  -- can't be used by someone who can read the database.
+  token_hash bytea PRIMARY KEY,
+  user_id    uuid NOT NULL REFERENCES users (id),
+  expires    timestamptz NOT NULL
+);
+
+CREATE INDEX ON password_resets (user_id);
@@ -0,0 +1,8 @@
+-- login_throttle records failed login attempts when THROTTLE_STORE is
+-- "postgres". See throttle.go.
+CREATE TABLE login_throttle (
+  key           text PRIMARY KEY,
+  failures      int NOT NULL,
+  last_failure  timestamptz NOT NULL,
+  blocked_until timestamptz NOT NULL
+);
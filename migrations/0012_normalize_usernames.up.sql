@@ -0,0 +1,5 @@
+-- Usernames are now stored in Unicode normalization form C, so that names
+-- that look the same compare equal. This migration is irreversible, since the
+-- original forms aren't kept. It fails if two existing names differ only in
+-- their normalization form; one of them must be renamed first.
+UPDATE users SET name = normalize(name, NFC) WHERE name IS NOT NFC NORMALIZED;
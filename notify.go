@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// A notifier delivers messages to users outside of the application, such as
+// password reset tokens.
+type notifier interface {
+	// notifyPasswordReset sends the given password reset token to the user
+	// with the given username.
+	notifyPasswordReset(username string, token string) error
+}
+
+// logNotifier writes notifications to a log instead of delivering them, for
+// local development.
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (n *logNotifier) notifyPasswordReset(username string, token string) error {
+	n.logger.Printf("Password reset token for user \"%v\": %v", username, token)
+	return nil
+}
+
+// newNotifier returns the notifier configured by the environment, or nil if
+// notifications are disabled. Since a logged password reset token lets anyone
+// who can read the log reset the user's password, notifications are only
+// logged if the operator opts in by setting NOTIFICATION_LOG: to "-" to write
+// them to the standard logger, which is meant for local development, or
+// otherwise to the name of a file that they are appended to. If
+// NOTIFICATION_LOG isn't set, notifications are disabled, and so are password
+// resets.
+func newNotifier() (notifier, error) {
+	path, ok := os.LookupEnv("NOTIFICATION_LOG")
+	if !ok || path == "" {
+		log.Println("NOTIFICATION_LOG not set; password resets are disabled")
+		return nil, nil
+	}
+	if path == "-" {
+		log.Println("Writing password reset tokens to the log; don't do this in production")
+		return &logNotifier{logger: log.Default()}, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &logNotifier{logger: log.New(f, "", log.LstdFlags)}, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file generates an OpenAPI 3 description of the /api endpoint. The
+// document is built at startup by reflecting over the operations registry and
+// the types in messages.go, so it can't drift from the wire format. The status
+// codes are written by hand, and openapi_test.go checks them against
+// apiHandler.ServeHTTP. The REST API (see rest.go) isn't described.
+//
+// OpenAPI describes operations by path and method, but every operation here
+// is a POST to /api, selected by the "operation" field. The request body is
+// therefore described as a oneOf with a discriminator on "operation", and each
+// request schema lists its possible responses in the "x-responses" extension.
+
+// openAPIHandler returns a handler that serves the OpenAPI document as JSON.
+// If the document can't be generated, openAPIHandler returns an error.
+func openAPIHandler() (http.HandlerFunc, error) {
+	spec, err := json.Marshal(openAPISpec())
+	if err != nil {
+		return nil, err
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(spec); err != nil {
+			log.Println(err)
+		}
+	}, nil
+}
+
+// openAPISpec returns the OpenAPI document as a value that can be marshaled
+// to JSON.
+func openAPISpec() map[string]any {
+	g := &schemaGenerator{schemas: map[string]any{}}
+	names := make([]string, 0, len(operations))
+	for name := range operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rqstRefs, respRefs []any
+	mapping := map[string]string{}
+	seenResps := map[string]bool{}
+	for _, name := range names {
+		op := operations[name]
+		t := op.serve.rqstType()
+		schema := g.structSchema(t, append([]string{"operation"}, op.required...))
+		schema["properties"].(map[string]any)["operation"] = map[string]any{
+			"type": "string",
+			"enum": []string{name},
+		}
+		var responses []any
+		for _, resp := range op.responses {
+			ref := g.ref(reflect.TypeOf(resp))
+			responses = append(responses, ref["$ref"])
+			if !seenResps[ref["$ref"]] {
+				seenResps[ref["$ref"]] = true
+				respRefs = append(respRefs, ref)
+			}
+		}
+		if len(responses) == 0 {
+			schema["description"] = "Responds with an empty body."
+		}
+		schema["x-responses"] = responses
+		schema["x-requires-login"] = op.requiresLogin
+		g.schemas[t.Name()] = schema
+		ref := "#/components/schemas/" + t.Name()
+		rqstRefs = append(rqstRefs, map[string]string{"$ref": ref})
+		mapping[name] = ref
+	}
+	errorRef := g.ref(reflect.TypeOf(errorResp{}))
+	errorContent := map[string]any{
+		"application/json": map[string]any{"schema": errorRef},
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "todo",
+			"version": "1",
+		},
+		"paths": map[string]any{
+			"/api": map[string]any{
+				"post": map[string]any{
+					"summary": "Perform the operation named by the \"operation\" field.",
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"oneOf": rqstRefs,
+									"discriminator": map[string]any{
+										"propertyName": "operation",
+										"mapping":      mapping,
+									},
+								},
+							},
+						},
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "The operation succeeded, or the client's todo list version is stale " +
+								"(versionMismatchResp). The \"x-responses\" extension of each request schema " +
+								"lists the responses it can receive. Some operations respond with an empty body.",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{"oneOf": respRefs},
+								},
+							},
+						},
+						"400": map[string]any{
+							"description": "The request is malformed or invalid, refers to a todo that does not exist, " +
+								"or requires login but has no cookie.",
+							"content": errorContent,
+						},
+						"401": map[string]any{
+							"description": "The session has expired or been revoked.",
+							"content":     errorContent,
+						},
+						"403": map[string]any{
+							"description": "The request came from another site.",
+							"content":     errorContent,
+						},
+						"405": map[string]any{
+							"description": "The request method is not POST.",
+							"content":     errorContent,
+						},
+						"413": map[string]any{
+							"description": "The request body is too large.",
+							"content":     errorContent,
+						},
+						"429": map[string]any{
+							"description": "Too many login, createUser, or requestPasswordReset requests were " +
+								"sent for the username or from the client's address.",
+							"headers": map[string]any{
+								"Retry-After": map[string]any{
+									"description": "The number of seconds to wait before retrying.",
+									"schema":      map[string]any{"type": "integer"},
+								},
+							},
+							"content": errorContent,
+						},
+						"500": map[string]any{
+							"description": "An internal error occurred.",
+						},
+						"503": map[string]any{
+							"description": "The operation took longer than its timeout, or password resets " +
+								"are disabled (requestPasswordReset and resetPassword).",
+							"content": errorContent,
+						},
+					},
+				},
+			},
+		},
+		"components": map[string]any{
+			"schemas": g.schemas,
+		},
+	}
+}
+
+// schemaGenerator generates OpenAPI schemas for Go types, collecting the
+// schemas of named struct types so that they can be referenced.
+type schemaGenerator struct {
+	schemas map[string]any
+}
+
+// ref returns a reference to the schema of the given named struct type (or
+// pointer to one), generating the schema if necessary. Every field of the
+// struct is considered required unless its json tag has the omitempty option.
+func (g *schemaGenerator) ref(t reflect.Type) map[string]string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if _, ok := g.schemas[t.Name()]; !ok {
+		g.schemas[t.Name()] = nil // Guard against recursive types.
+		g.schemas[t.Name()] = g.structSchema(t, nil)
+	}
+	return map[string]string{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+// structSchema returns the schema of the given struct type. If required is
+// nil, every field without the omitempty option is required.
+func (g *schemaGenerator) structSchema(t reflect.Type, required []string) map[string]any {
+	properties := map[string]any{}
+	requireAll := required == nil
+	g.addFields(t, properties, &required, requireAll)
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds the schemas of the fields of the given struct type to
+// properties, including the fields of embedded structs, as encoding/json
+// does. If requireAll is true, the names of fields without the omitempty
+// option are appended to required.
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]any, required *[]string, requireAll bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			g.addFields(f.Type, properties, required, requireAll)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schema(f.Type)
+		if requireAll && !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// schemaProvider is implemented by types that aren't encoded according to
+// their Go structure, so they must describe their own schemas.
+type schemaProvider interface {
+	openAPISchema(g *schemaGenerator) any
+}
+
+// schema returns the schema of the given type.
+func (g *schemaGenerator) schema(t reflect.Type) any {
+	if p, ok := reflect.Zero(t).Interface().(schemaProvider); ok {
+		return p.openAPISchema(g)
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := map[string]any{"nullable": true}
+		for k, v := range g.schema(t.Elem()).(map[string]any) {
+			s[k] = v
+		}
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]any{
+			"type":     "array",
+			"items":    g.schema(t.Elem()),
+			"minItems": t.Len(),
+			"maxItems": t.Len(),
+		}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t, nil)
+		}
+		return map[string]any{"allOf": []any{g.ref(t)}}
+	}
+	panic(fmt.Sprintf("openapi: unsupported type %v", t))
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// These tests check the OpenAPI document against the behavior of
+// apiHandler.ServeHTTP. They don't need a database: requests that reach the
+// database either time out, because the database never answers, or fail,
+// because it refuses connections.
+
+// testSpec returns the OpenAPI document as it is served, i.e. decoded from
+// JSON.
+func testSpec(t *testing.T) map[string]any {
+	t.Helper()
+	b, err := json.Marshal(openAPISpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(b, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// component returns the schema with the given name or reference.
+func component(t *testing.T, spec map[string]any, ref string) map[string]any {
+	t.Helper()
+	name := strings.TrimPrefix(ref, "#/components/schemas/")
+	schema, ok := spec["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+	if !ok {
+		t.Fatalf("no schema for %q", ref)
+	}
+	return schema
+}
+
+// resolve returns the schema that the given schema refers to, if it is a
+// reference.
+func resolve(t *testing.T, spec map[string]any, schema map[string]any) map[string]any {
+	t.Helper()
+	if ref, ok := schema["$ref"].(string); ok {
+		return component(t, spec, ref)
+	}
+	if allOf, ok := schema["allOf"].([]any); ok && len(allOf) == 1 {
+		return resolve(t, spec, allOf[0].(map[string]any))
+	}
+	return schema
+}
+
+// apiResponses returns the responses of POST /api by status code.
+func apiResponses(spec map[string]any) map[string]any {
+	paths := spec["paths"].(map[string]any)
+	return paths["/api"].(map[string]any)["post"].(map[string]any)["responses"].(map[string]any)
+}
+
+// sampleValue returns a value of the type described by the given schema.
+func sampleValue(t *testing.T, spec map[string]any, schema map[string]any) any {
+	t.Helper()
+	schema = resolve(t, spec, schema)
+	switch schema["type"] {
+	case "string":
+		if enum, ok := schema["enum"].([]any); ok {
+			return enum[0]
+		}
+		if schema["format"] == "date-time" {
+			return "2024-01-02T03:04:05Z"
+		}
+		return "a"
+	case "integer", "number":
+		return 1
+	case "boolean":
+		return true
+	case "array":
+		return []any{}
+	case "object":
+		return map[string]any{}
+	}
+	t.Fatalf("no sample value for schema %v", schema)
+	return nil
+}
+
+// wrongValue returns a value that doesn't match the type described by the
+// given schema.
+func wrongValue(t *testing.T, spec map[string]any, schema map[string]any) any {
+	t.Helper()
+	if resolve(t, spec, schema)["type"] == "string" {
+		return 1
+	}
+	return "a"
+}
+
+// hangingDB returns the address of a server that accepts connections but
+// never responds.
+func hangingDB(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return l.Addr().String()
+}
+
+// refusingDB returns an address that refuses connections.
+func refusingDB(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// newTestAPIHandler returns an apiHandler whose database is at the given
+// address.
+func newTestAPIHandler(t *testing.T, dbAddr string) *apiHandler {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	t.Setenv("JWT_SIGNING_KEY", "YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=")
+	jwtKeys, err := loadJWTKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwdHasher, err := newPasswordHasher(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := pgxpool.New(context.Background(), "postgres://todo@"+dbAddr+"/todo?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return &apiHandler{
+		pool:               newDBPool(pool),
+		jwtKeys:            jwtKeys,
+		cookieName:         "accessToken",
+		cookieAttrs:        newCookieAttrs(),
+		origins:            newOriginChecker(),
+		pwdHasher:          pwdHasher,
+		sessionLifetime:    time.Hour,
+		changes:            newChangeHub(),
+		throttles:          newLoginThrottles(newMemoryThrottleStore()),
+		resetTokenLifetime: time.Hour,
+		timeouts:           &opTimeouts{def: 200 * time.Millisecond, byOp: map[string]time.Duration{}},
+		shutdown:           make(chan struct{}),
+	}
+}
+
+// serveAPI sends a POST request with the given body to h and returns the
+// response.
+func serveAPI(h *apiHandler, body any, modify ...func(r *http.Request)) *httptest.ResponseRecorder {
+	var b []byte
+	switch body := body.(type) {
+	case string:
+		b = []byte(body)
+	default:
+		b, _ = json.Marshal(body)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api", bytes.NewReader(b))
+	for _, m := range modify {
+		m(r)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// errorCode returns the code of the errorResp in the given response, or "" if
+// the body isn't an errorResp.
+func errorCode(w *httptest.ResponseRecorder) string {
+	return decodeError(w).Code
+}
+
+// decodeError returns the errorResp in the given response, which is empty if
+// the body isn't an errorResp.
+func decodeError(w *httptest.ResponseRecorder) *errorResp {
+	e := &errorResp{}
+	if err := json.Unmarshal(w.Body.Bytes(), e); err != nil {
+		return &errorResp{}
+	}
+	return e
+}
+
+// requiredBody returns a request for the given operation with every field
+// that the document says is required, except the given ones.
+func requiredBody(t *testing.T, spec map[string]any, name string, schema map[string]any, except ...string) map[string]any {
+	t.Helper()
+	body := map[string]any{"operation": name}
+	properties := schema["properties"].(map[string]any)
+	for _, f := range schema["required"].([]any) {
+		f := f.(string)
+		if f == "operation" || contains(except, f) {
+			continue
+		}
+		body[f] = sampleValue(t, spec, properties[f].(map[string]any))
+	}
+	return body
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// TestOpenAPIRequests checks that each operation's request schema matches the
+// fields that ServeHTTP requires and decodes, and whether it requires login.
+func TestOpenAPIRequests(t *testing.T) {
+	spec := testSpec(t)
+	h := newTestAPIHandler(t, hangingDB(t))
+	for name, op := range operations {
+		name, op := name, op
+		t.Run(name, func(t *testing.T) {
+			rqstType := op.serve.rqstType()
+			schema := component(t, spec, rqstType.Name())
+			properties := schema["properties"].(map[string]any)
+
+			var required []string
+			for _, f := range schema["required"].([]any) {
+				required = append(required, f.(string))
+			}
+			want := append([]string{"operation"}, op.required...)
+			sort.Strings(required)
+			sort.Strings(want)
+			if !reflect.DeepEqual(required, want) {
+				t.Errorf("required fields are %v, want %v", required, want)
+			}
+
+			// Every required field is checked.
+			for _, f := range op.required {
+				w := serveAPI(h, requiredBody(t, spec, name, schema, f))
+				e := decodeError(w)
+				if w.Code != http.StatusBadRequest || e.Code != "missingField" ||
+					!strings.Contains(e.Message, strconv.Quote(f)) {
+					t.Errorf("without %q: got %v %s, want missingField", f, w.Code, w.Body)
+				}
+			}
+
+			// With the required fields, login is checked next.
+			w := serveAPI(h, requiredBody(t, spec, name, schema))
+			if errorCode(w) == "missingField" {
+				t.Fatalf("with required fields: got %s", w.Body)
+			}
+			gotLogin := errorCode(w) == "notLoggedIn"
+			if gotLogin != op.requiresLogin || schema["x-requires-login"] != op.requiresLogin {
+				t.Errorf("x-requires-login is %v, but the response without a cookie is %v %s",
+					schema["x-requires-login"], w.Code, w.Body)
+			}
+
+			// Every documented property is decoded with its documented type.
+			decode := func(body map[string]any) string {
+				b, _ := json.Marshal(body)
+				r := httptest.NewRequest(http.MethodPost, "/api", bytes.NewReader(b))
+				ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+				defer cancel()
+				w := httptest.NewRecorder()
+				op.serve.serveRqst(h, w, r.WithContext(ctx), b, "00000000-0000-0000-0000-000000000000")
+				return w.Body.String()
+			}
+			if resp := decode(requiredBody(t, spec, name, schema)); strings.Contains(resp, "cannot unmarshal") {
+				t.Fatalf("documented types of required fields aren't decoded: %v", resp)
+			}
+			for f, p := range properties {
+				if f == "operation" {
+					continue
+				}
+				body := requiredBody(t, spec, name, schema)
+				body[f] = wrongValue(t, spec, p.(map[string]any))
+				if resp := decode(body); !strings.Contains(resp, "cannot unmarshal") {
+					t.Errorf("property %q isn't decoded with its documented type: got %v", f, resp)
+				}
+			}
+
+			// Every field that is encoded is documented.
+			b, err := json.Marshal(reflect.New(rqstType).Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal(b, &fields); err != nil {
+				t.Fatal(err)
+			}
+			for f := range fields {
+				if _, ok := properties[f]; !ok {
+					t.Errorf("field %q isn't documented", f)
+				}
+			}
+		})
+	}
+}
+
+// jsonFields returns the names of the fields of the given struct type in its
+// JSON encoding, following the rules of encoding/json for tags and embedded
+// structs.
+func jsonFields(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && tag == "" {
+			names = append(names, jsonFields(f.Type)...)
+			continue
+		}
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// TestOpenAPISchemasMatchTypes checks that the properties of the schema of
+// each request and response type are exactly the fields of the type.
+func TestOpenAPISchemasMatchTypes(t *testing.T) {
+	spec := testSpec(t)
+	types := map[string]reflect.Type{}
+	for _, op := range operations {
+		rqstType := op.serve.rqstType()
+		types[rqstType.Name()] = rqstType
+		for _, resp := range op.responses {
+			respType := reflect.TypeOf(resp).Elem()
+			types[respType.Name()] = respType
+		}
+	}
+	types["errorResp"] = reflect.TypeOf(errorResp{})
+	for name, typ := range types {
+		var properties []string
+		for p := range component(t, spec, name)["properties"].(map[string]any) {
+			properties = append(properties, p)
+		}
+		fields := jsonFields(typ)
+		sort.Strings(properties)
+		sort.Strings(fields)
+		if !reflect.DeepEqual(properties, fields) {
+			t.Errorf("%v: the schema's properties are %v, but the type's fields are %v",
+				name, properties, fields)
+		}
+	}
+}
+
+// checkBody reports an error if the given JSON object doesn't match the given
+// schema: each of its fields must be documented, and each required field must
+// be present.
+func checkBody(t *testing.T, schema map[string]any, body []byte) {
+	t.Helper()
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Errorf("response %s isn't a JSON object: %v", body, err)
+		return
+	}
+	properties := schema["properties"].(map[string]any)
+	for f := range fields {
+		if _, ok := properties[f]; !ok {
+			t.Errorf("field %q of %s isn't documented", f, body)
+		}
+	}
+	required, _ := schema["required"].([]any)
+	for _, f := range required {
+		if _, ok := fields[f.(string)]; !ok {
+			t.Errorf("required field %q is missing from %s", f, body)
+		}
+	}
+}
+
+// TestOpenAPIResponses checks that each operation's documented responses
+// match the JSON encoding of its response types, and the responses that
+// ServeHTTP sends without a database.
+func TestOpenAPIResponses(t *testing.T) {
+	spec := testSpec(t)
+	for name, op := range operations {
+		schema := component(t, spec, op.serve.rqstType().Name())
+		refs, _ := schema["x-responses"].([]any)
+		if len(refs) != len(op.responses) {
+			t.Errorf("%v: x-responses is %v, want %v responses", name, refs, len(op.responses))
+			continue
+		}
+		for i, resp := range op.responses {
+			ref := refs[i].(string)
+			if !strings.HasSuffix(ref, "/"+reflect.TypeOf(resp).Elem().Name()) {
+				t.Errorf("%v: x-responses[%v] is %v, want %T", name, i, ref, resp)
+			}
+			b, err := json.Marshal(reflect.New(reflect.TypeOf(resp).Elem()).Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkBody(t, component(t, spec, ref), b)
+		}
+	}
+
+	h := newTestAPIHandler(t, hangingDB(t))
+	// getUsername responds without a database if there is no cookie.
+	w := serveAPI(h, `{"operation":"getUsername"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("getUsername: got %v %s", w.Code, w.Body)
+	}
+	checkBody(t, component(t, spec, "getUsernameResp"), w.Body.Bytes())
+	// logout is documented as responding with an empty body.
+	w = serveAPI(h, `{"operation":"logout"}`)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || len(operations["logout"].responses) != 0 {
+		t.Errorf("logout: got %v %q", w.Code, w.Body)
+	}
+}
+
+// TestOpenAPIStatusCodes checks that the documented status codes of POST /api
+// are exactly those that ServeHTTP sends, and that their bodies and headers
+// are as documented.
+func TestOpenAPIStatusCodes(t *testing.T) {
+	spec := testSpec(t)
+	h := newTestAPIHandler(t, hangingDB(t))
+	refused := newTestAPIHandler(t, refusingDB(t))
+
+	expired, err := h.jwtKeys.sign(&sessionClaims{
+		UID: "00000000-0000-0000-0000-000000000000",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "session",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lock out the address that httptest.NewRequest uses.
+	for {
+		wait, err := h.throttles.ip.attempt(context.Background(), "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait > 0 {
+			break
+		}
+	}
+	createUser := `{"operation":"createUser","username":"alice","password":"correct horse"}`
+
+	tests := []struct {
+		name   string
+		w      *httptest.ResponseRecorder
+		status int
+	}{
+		{"success", serveAPI(h, `{"operation":"getUsername"}`), http.StatusOK},
+		{"malformed", serveAPI(h, `[]`), http.StatusBadRequest},
+		{"unknown operation", serveAPI(h, `{"operation":"nope"}`), http.StatusBadRequest},
+		{"invalid field", serveAPI(h, `{"operation":"createUser","username":"","password":"correct horse"}`),
+			http.StatusBadRequest},
+		{"not logged in", serveAPI(h, `{"operation":"getTodos"}`), http.StatusBadRequest},
+		{"expired session", serveAPI(h, `{"operation":"getTodos"}`, func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "accessToken", Value: expired})
+		}), http.StatusUnauthorized},
+		{"cross-site", serveAPI(h, `{"operation":"getUsername"}`, func(r *http.Request) {
+			r.Header.Set("Sec-Fetch-Site", "cross-site")
+		}), http.StatusForbidden},
+		{"method", func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api", nil))
+			return w
+		}(), http.StatusMethodNotAllowed},
+		{"too large", serveAPI(h, strings.Repeat(" ", maxRqstSize+1)), http.StatusRequestEntityTooLarge},
+		{"throttled", serveAPI(h, `{"operation":"login","username":"alice","password":"correct horse"}`),
+			http.StatusTooManyRequests},
+		{"database error", serveAPI(refused, createUser), http.StatusInternalServerError},
+		{"timeout", serveAPI(h, createUser), http.StatusServiceUnavailable},
+		{"password reset disabled", serveAPI(h, `{"operation":"requestPasswordReset","username":"alice"}`),
+			http.StatusServiceUnavailable},
+	}
+	documented := apiResponses(spec)
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		status := strconv.Itoa(tt.status)
+		seen[status] = true
+		if tt.w.Code != tt.status {
+			t.Errorf("%v: got %v %s, want %v", tt.name, tt.w.Code, tt.w.Body, tt.status)
+			continue
+		}
+		doc, ok := documented[status].(map[string]any)
+		if !ok {
+			t.Errorf("%v: status %v isn't documented", tt.name, status)
+			continue
+		}
+		if tt.status == http.StatusOK {
+			continue
+		}
+		content, _ := doc["content"].(map[string]any)
+		if tt.w.Body.Len() == 0 {
+			if content != nil {
+				t.Errorf("%v: status %v is documented with content, but the body is empty", tt.name, status)
+			}
+			continue
+		}
+		if content == nil {
+			t.Errorf("%v: status %v is documented without content, but the body is %s", tt.name, status, tt.w.Body)
+			continue
+		}
+		schema := content["application/json"].(map[string]any)["schema"].(map[string]any)
+		checkBody(t, resolve(t, spec, schema), tt.w.Body.Bytes())
+		headers, _ := doc["headers"].(map[string]any)
+		for name := range headers {
+			if tt.w.Header().Get(name) == "" {
+				t.Errorf("%v: documented header %v is missing", tt.name, name)
+			}
+		}
+	}
+	for status := range documented {
+		if !seen[status] {
+			t.Errorf("status %v is documented but not tested", status)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHasher hashes and verifies user passwords with bcrypt. bcrypt
+// generates a random salt for every hash and encodes the salt and cost in the
+// hash itself, so nothing besides the hash needs to be stored.
+type passwordHasher struct {
+	// cost is the bcrypt cost used for new hashes. Stored hashes with a
+	// different cost are rehashed the next time the user logs in.
+	cost int
+	// dummyHash is compared against when the user doesn't exist, so that
+	// login takes about the same amount of time whether or not the username is
+	// valid.
+	dummyHash []byte
+}
+
+// newPasswordHasher returns a passwordHasher that uses the given cost, or an
+// error if the cost is outside of the range that bcrypt allows.
+func newPasswordHasher(cost int) (*passwordHasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, errors.New("password hash cost is out of range")
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), cost)
+	if err != nil {
+		return nil, err
+	}
+	return &passwordHasher{cost: cost, dummyHash: dummyHash}, nil
+}
+
+// hash returns the encoded hash of the given password.
+func (p *passwordHasher) hash(pwd string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pwd), p.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// verify checks the given password against the stored password, which is
+// either a bcrypt hash or, for accounts created before passwords were hashed,
+// the plaintext password. The comparison takes constant time with respect to
+// the password contents.
+//
+// needsRehash is true if the password matched but stored should be replaced
+// with a fresh hash, either because it is plaintext or because it was hashed
+// with a different cost.
+func (p *passwordHasher) verify(pwd string, stored string) (match bool, needsRehash bool) {
+	if !isBcryptHash(stored) {
+		match = subtle.ConstantTimeCompare([]byte(pwd), []byte(stored)) == 1
+		return match, match
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(pwd))
+	if err != nil {
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			log.Printf("Failed to compare password hash: %v", err)
+		}
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost != p.cost
+}
+
+// verifyDummy performs the same amount of work as verify, and should be
+// called when there is no stored password to compare against.
+func (p *passwordHasher) verifyDummy(pwd string) {
+	//nolint:errcheck // The result is meaningless; only the delay matters.
+	bcrypt.CompareHashAndPassword(p.dummyHash, []byte(pwd))
+}
+
+// isBcryptHash reports whether s looks like an encoded bcrypt hash, as opposed
+// to a legacy plaintext password.
+func isBcryptHash(s string) bool {
+	if len(s) != 60 || !strings.HasPrefix(s, "$2") {
+		return false
+	}
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
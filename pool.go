@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// dbPool is a connection pool that counts the callers that are waiting for a
+// connection, which pgxpool doesn't report (see poolMetrics). It shadows the
+// methods of pgxpool.Pool that acquire a connection, acquiring it with its
+// own Acquire method, as pgxpool.Pool does internally.
+type dbPool struct {
+	*pgxpool.Pool
+	// waiting is the number of Acquire calls that haven't returned yet.
+	waiting atomic.Int64
+}
+
+func newDBPool(pool *pgxpool.Pool) *dbPool {
+	return &dbPool{Pool: pool}
+}
+
+func (p *dbPool) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	p.waiting.Add(1)
+	defer p.waiting.Add(-1)
+	return p.Pool.Acquire(ctx)
+}
+
+func (p *dbPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	c, err := p.Acquire(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer c.Release()
+	return c.Exec(ctx, sql, args...)
+}
+
+func (p *dbPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	c, err := p.Acquire(ctx)
+	if err != nil {
+		return &poolRow{err: err}
+	}
+	return &poolRow{row: c.QueryRow(ctx, sql, args...), conn: c}
+}
+
+func (p *dbPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	return p.BeginTx(ctx, pgx.TxOptions{})
+}
+
+func (p *dbPool) BeginTx(ctx context.Context, opts pgx.TxOptions) (pgx.Tx, error) {
+	c, err := p.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := c.BeginTx(ctx, opts)
+	if err != nil {
+		c.Release()
+		return nil, err
+	}
+	return &poolTx{Tx: tx, conn: c}, nil
+}
+
+// poolRow releases its connection once it has been scanned.
+type poolRow struct {
+	row  pgx.Row
+	conn *pgxpool.Conn
+	err  error
+}
+
+func (r *poolRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.conn.Release()
+	return r.row.Scan(dest...)
+}
+
+// poolTx releases its connection once it has been committed or rolled back.
+type poolTx struct {
+	pgx.Tx
+	conn *pgxpool.Conn
+}
+
+func (t *poolTx) Commit(ctx context.Context) error {
+	err := t.Tx.Commit(ctx)
+	t.release()
+	return err
+}
+
+func (t *poolTx) Rollback(ctx context.Context) error {
+	err := t.Tx.Rollback(ctx)
+	t.release()
+	return err
+}
+
+func (t *poolTx) release() {
+	if t.conn != nil {
+		t.conn.Release()
+		t.conn = nil
+	}
+}
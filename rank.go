@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// This file implements fractional indexing, which is used to order todos. Each
+// todo has a position key, and todos are sorted by comparing keys byte by
+// byte. A key can always be generated between any two other keys, so moving a
+// todo only changes that todo's key.
+//
+// A key consists of an integer part followed by an optional fractional part.
+// The first character of the integer part determines its length: 'a' through
+// 'z' are followed by 1 through 26 digits, and 'A' through 'Z' are followed by
+// 26 through 1 digits (and sort before the lowercase heads). Keys appended to
+// the end of a list increment the integer part, so they grow logarithmically
+// rather than linearly with the number of appends. The fractional part is used
+// to generate keys between consecutive integers; it never ends in the zero
+// digit, since no key would sort between "x" and "x0".
+//
+// Keys must be compared bytewise, so the position column uses the "C"
+// collation.
+
+// rankDigits are the base-62 digits, in ascending byte order.
+const rankDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// smallestRankInteger is the smallest possible integer part.
+const smallestRankInteger = "A00000000000000000000000000"
+
+var errRankOverflow = errors.New("position key out of range")
+
+// keyBetween returns a key that sorts strictly between a and b. a == ""
+// means there is no lower bound, and b == "" means there is no upper bound.
+// a must sort before b.
+func keyBetween(a string, b string) (string, error) {
+	if a == "" && b == "" {
+		return "a0", nil
+	}
+	if a == "" {
+		ib, err := rankIntegerPart(b)
+		if err != nil {
+			return "", err
+		}
+		fb := b[len(ib):]
+		if ib == smallestRankInteger {
+			if fb == "" {
+				// No key sorts before the smallest integer.
+				return "", errRankOverflow
+			}
+			return ib + rankMidpoint("", fb), nil
+		}
+		if fb != "" {
+			return ib, nil
+		}
+		i, err := decrementRankInteger(ib)
+		if err != nil {
+			return "", err
+		}
+		if i == smallestRankInteger {
+			// Leave room for keys before the new one.
+			return i + rankMidpoint("", ""), nil
+		}
+		return i, nil
+	}
+	ia, err := rankIntegerPart(a)
+	if err != nil {
+		return "", err
+	}
+	fa := a[len(ia):]
+	if b == "" {
+		i, err := incrementRankInteger(ia)
+		if err == errRankOverflow {
+			return ia + rankMidpoint(fa, ""), nil
+		}
+		return i, err
+	}
+	ib, err := rankIntegerPart(b)
+	if err != nil {
+		return "", err
+	}
+	if ia == ib {
+		return ia + rankMidpoint(fa, b[len(ib):]), nil
+	}
+	i, err := incrementRankInteger(ia)
+	if err == nil && i < b {
+		return i, nil
+	}
+	return ia + rankMidpoint(fa, ""), nil
+}
+
+// rankMidpoint returns a fractional part that sorts strictly between the
+// fractional parts a and b. b == "" means there is no upper bound.
+func rankMidpoint(a string, b string) string {
+	if b != "" {
+		// Skip the common prefix, treating a as padded with zeros.
+		n := 0
+		for n < len(b) && rankDigitAt(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(a) {
+				rest = a[n:]
+			}
+			return b[:n] + rankMidpoint(rest, b[n:])
+		}
+	}
+	digitA := 0
+	if a != "" {
+		digitA = strings.IndexByte(rankDigits, a[0])
+	}
+	digitB := len(rankDigits)
+	if b != "" {
+		digitB = strings.IndexByte(rankDigits, b[0])
+	}
+	if digitB-digitA > 1 {
+		return string(rankDigits[(digitA+digitB)/2])
+	}
+	// The first digits are consecutive.
+	if len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if len(a) > 1 {
+		rest = a[1:]
+	}
+	return string(rankDigits[digitA]) + rankMidpoint(rest, "")
+}
+
+// rankDigitAt returns the digit at index i of s, or the zero digit if s is too
+// short.
+func rankDigitAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return rankDigits[0]
+}
+
+// rankIntegerPart returns the integer part of the given key.
+func rankIntegerPart(key string) (string, error) {
+	n, err := rankIntegerLength(key[0])
+	if err != nil {
+		return "", err
+	}
+	if n > len(key) {
+		return "", errors.New("malformed position key")
+	}
+	return key[:n], nil
+}
+
+// rankIntegerLength returns the length of an integer part, including the
+// head.
+func rankIntegerLength(head byte) (int, error) {
+	switch {
+	case head >= 'a' && head <= 'z':
+		return int(head-'a') + 2, nil
+	case head >= 'A' && head <= 'Z':
+		return int('Z'-head) + 2, nil
+	}
+	return 0, errors.New("malformed position key")
+}
+
+func incrementRankInteger(x string) (string, error) {
+	head, digits := x[0], []byte(x[1:])
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := strings.IndexByte(rankDigits, digits[i]) + 1
+		if d < len(rankDigits) {
+			digits[i] = rankDigits[d]
+			return string(head) + string(digits), nil
+		}
+		digits[i] = rankDigits[0]
+	}
+	// Every digit carried over, so the integer part grows.
+	switch head {
+	case 'Z':
+		return "a0", nil
+	case 'z':
+		return "", errRankOverflow
+	}
+	head++
+	if head > 'a' {
+		digits = append(digits, rankDigits[0])
+	} else {
+		digits = digits[:len(digits)-1]
+	}
+	return string(head) + string(digits), nil
+}
+
+func decrementRankInteger(x string) (string, error) {
+	head, digits := x[0], []byte(x[1:])
+	last := rankDigits[len(rankDigits)-1]
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := strings.IndexByte(rankDigits, digits[i]) - 1
+		if d >= 0 {
+			digits[i] = rankDigits[d]
+			return string(head) + string(digits), nil
+		}
+		digits[i] = last
+	}
+	// Every digit borrowed, so the integer part shrinks.
+	switch head {
+	case 'a':
+		return "Z" + string(last), nil
+	case 'A':
+		return "", errRankOverflow
+	}
+	head--
+	if head < 'Z' {
+		digits = append(digits, last)
+	} else {
+		digits = digits[:len(digits)-1]
+	}
+	return string(head) + string(digits), nil
+}
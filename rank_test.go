@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyBetween(t *testing.T) {
+	largest := "z" + strings.Repeat("z", 26)
+	tests := []struct {
+		a, b string
+	}{
+		{"", ""},
+		{"a0", ""},
+		{"", "a0"},
+		{"a0", "a1"},
+		{"a0", "a0V"},
+		{"a0", "a00V"},
+		{"a0V", "a1"},
+		{"a0V", "a0W"},
+		{"a0z", "a1"},
+		{"a1", "a3"},
+		{"az", "b100"},
+		{"Zz", "a0"},
+		{"Zz", ""},
+		{"", "Zz"},
+		{"", "b10"},
+		{"", smallestRankInteger + "1"},
+		{"", smallestRankInteger + "V"},
+		{"", "A" + strings.Repeat("0", 25) + "1"},
+		{largest, ""},
+		{"y" + strings.Repeat("z", 25), ""},
+		// Keys assigned by migration 0006.
+		{"", "a00000000001V"},
+		{"a00000000001V", "a00000000002V"},
+		{"a00000000009V", "a00000000010V"},
+		{"a00000000002V", ""},
+	}
+	for _, tt := range tests {
+		k, err := keyBetween(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("keyBetween(%q, %q): %v", tt.a, tt.b, err)
+			continue
+		}
+		checkBetween(t, tt.a, k, tt.b)
+	}
+	// No key sorts before the smallest integer.
+	if k, err := keyBetween("", smallestRankInteger); err != errRankOverflow {
+		t.Errorf("keyBetween(%q, %q) = %q, %v, want errRankOverflow", "", smallestRankInteger, k, err)
+	}
+}
+
+// checkBetween reports an error unless a < k < b, where an empty a or b is
+// no bound, and k is well-formed.
+func checkBetween(t *testing.T, a string, k string, b string) {
+	t.Helper()
+	if (a != "" && k <= a) || (b != "" && k >= b) {
+		t.Errorf("keyBetween(%q, %q) = %q, which isn't between them", a, b, k)
+	}
+	i, err := rankIntegerPart(k)
+	if err != nil {
+		t.Errorf("keyBetween(%q, %q) = %q: %v", a, b, k, err)
+		return
+	}
+	if f := k[len(i):]; strings.HasSuffix(f, "0") {
+		t.Errorf("keyBetween(%q, %q) = %q, whose fractional part ends in zero", a, b, k)
+	}
+}
+
+func TestKeyBetweenRepeated(t *testing.T) {
+	tests := []struct {
+		name string
+		next func(k string) (a string, b string)
+	}{
+		{"append", func(k string) (string, string) { return k, "" }},
+		{"prepend", func(k string) (string, string) { return "", k }},
+		{"insert after first", func(k string) (string, string) { return "a0", k }},
+		{"insert before last", func(k string) (string, string) { return k, "a1" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := "a0V"
+			for i := 0; i < 5000; i++ {
+				a, b := tt.next(k)
+				next, err := keyBetween(a, b)
+				if err != nil {
+					t.Fatalf("after %v keys: keyBetween(%q, %q): %v", i, a, b, err)
+				}
+				checkBetween(t, a, next, b)
+				if t.Failed() {
+					return
+				}
+				k = next
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// restHandler serves a resource-oriented view of the API under /api/v1/, for
+// clients that would rather not use the single operation-based endpoint. It
+// reuses the same transactions as apiHandler.
+//
+// The todo list version is carried in the ETag response header, and requests
+// that modify the list must send the version they were based on in the
+// If-Match header. If the version is stale and the change conflicts with
+// someone else's, 412 Precondition Failed is sent along with a fresh snapshot
+// of the list, as in versionMismatchResp. If the version is stale but the
+// change was merged, the snapshot is sent with the usual success status.
+//
+// Snapshots are sent as [id, value] pairs unless the structured query
+// parameter is "true" (see todoList). The todo resources belong to the user's
+// default list unless the listId query parameter names another list.
+//
+// The resources are:
+//
+//	GET    /api/v1/todos       get the todo list
+//	POST   /api/v1/todos       append a todo; the body is a restNewTodo
+//	PATCH  /api/v1/todos/{id}  update a todo's value and attributes; the body is a restTodoUpdate
+//	DELETE /api/v1/todos/{id}  delete a todo
+//	GET    /api/v1/session     get the logged in username
+//	POST   /api/v1/session     log in; the body is a loginRqst
+//	DELETE /api/v1/session     log out
+//	POST   /api/v1/users       create a user and log in; the body is a createUserRqst
+//	DELETE /api/v1/users/me    delete the logged in user; the body is a deleteUserRqst
+//	PUT    /api/v1/users/me/password
+//	                           change the password; the body is a changePasswordRqst
+//	POST   /api/v1/password-resets
+//	                           send a password reset token; the body is a requestPasswordResetRqst
+//	POST   /api/v1/password-resets/redeem
+//	                           reset a password; the body is a resetPasswordRqst
+type restHandler struct {
+	*apiHandler
+}
+
+// restOperations maps each REST route to the operation that it corresponds
+// to, whose timeout applies to it (see opTimeouts).
+var restOperations = map[string]string{
+	"GET /todos":                   "getTodos",
+	"POST /todos":                  "appendTodo",
+	"PATCH /todos/{id}":            "updateTodo",
+	"DELETE /todos/{id}":           "deleteTodo",
+	"GET /session":                 "getUsername",
+	"POST /session":                "login",
+	"DELETE /session":              "logout",
+	"POST /users":                  "createUser",
+	"DELETE /users/me":             "deleteUser",
+	"PUT /users/me/password":       "changePassword",
+	"POST /password-resets":        "requestPasswordReset",
+	"POST /password-resets/redeem": "resetPassword",
+}
+
+func (h *restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !h.checkOrigin(w, r) {
+		return
+	}
+	route := path
+	if strings.HasPrefix(path, "/todos/") {
+		route = "/todos/{id}"
+	}
+	op := restOperations[r.Method+" "+route]
+	if op != "" {
+		var record func()
+		w, record = recordRequest(w, op)
+		defer record()
+	}
+	r, cancel := h.timeouts.withTimeout(r, op)
+	defer cancel()
+	switch {
+	case path == "/todos":
+		switch r.Method {
+		case http.MethodGet:
+			withVerifyCookie(func(uid string) { h.serveRESTGetTodos(w, r, uid) })(h.apiHandler, w, r)
+		case http.MethodPost:
+			withVerifyCookie(func(uid string) { h.serveRESTAppendTodo(w, r, uid) })(h.apiHandler, w, r)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case strings.HasPrefix(path, "/todos/") && !strings.Contains(path[len("/todos/"):], "/"):
+		id := path[len("/todos/"):]
+		if validateTodoID(id) != nil {
+			writeError(w, http.StatusNotFound, "todoNotFound", "the todo does not exist")
+			return
+		}
+		switch r.Method {
+		case http.MethodPatch:
+			withVerifyCookie(func(uid string) { h.serveRESTUpdateTodo(w, r, id, uid) })(h.apiHandler, w, r)
+		case http.MethodDelete:
+			withVerifyCookie(func(uid string) { h.serveRESTDeleteTodo(w, r, id, uid) })(h.apiHandler, w, r)
+		default:
+			writeMethodNotAllowed(w, http.MethodPatch, http.MethodDelete)
+		}
+	case path == "/session":
+		switch r.Method {
+		case http.MethodGet:
+			h.serveGetUsername(w, r)
+		case http.MethodPost:
+			h.serveRESTLogin(w, r)
+		case http.MethodDelete:
+			h.serveLogout(w, r)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+		}
+	case path == "/users":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.serveRESTCreateUser(w, r)
+	case path == "/users/me":
+		if r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		withVerifyCookie(func(uid string) { h.serveRESTDeleteUser(w, r, uid) })(h.apiHandler, w, r)
+	case path == "/users/me/password":
+		if r.Method != http.MethodPut {
+			writeMethodNotAllowed(w, http.MethodPut)
+			return
+		}
+		withVerifyCookie(func(uid string) { h.serveRESTChangePassword(w, r, uid) })(h.apiHandler, w, r)
+	case path == "/password-resets":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.serveRESTRequestPasswordReset(w, r)
+	case path == "/password-resets/redeem":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.serveRESTResetPassword(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "no such resource")
+	}
+}
+
+func (h *restHandler) serveRESTGetTodos(w http.ResponseWriter, r *http.Request, uid string) {
+	listID, ok := listParam(w, r)
+	if !ok {
+		return
+	}
+	resp, e, ok := h.txGetTodos(r.Context(), uid, listID, structuredParam(r))
+	if !ok {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if e != nil {
+		writeError(w, restErrorStatus(e), e.Code, e.Message)
+		return
+	}
+	writeETag(w, resp.Version)
+	writeJSON(w, resp)
+}
+
+func (h *restHandler) serveRESTAppendTodo(w http.ResponseWriter, r *http.Request, uid string) {
+	listID, ok := listParam(w, r)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	body := &restNewTodo{}
+	if !readBody(w, r, body, "id") {
+		return
+	}
+	rqst := &appendTodoRqst{Version: version, ID: body.ID}
+	rqst.ListID = listID
+	rqst.Structured = structuredParam(r)
+	resp := h.txAppendTodo(r.Context(), rqst, uid)
+	switch resp := resp.(type) {
+	case *appendTodoResp:
+		writeETag(w, resp.Version)
+		w.Header().Set("Location", "/api/v1/todos/"+body.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, resp)
+	case *versionMismatchResp:
+		// Appends are carried out even if the version is stale, so the
+		// snapshot includes the new todo.
+		writeETag(w, resp.Version)
+		w.Header().Set("Location", "/api/v1/todos/"+body.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, resp)
+	case *errorResp:
+		writeError(w, restErrorStatus(resp), resp.Code, resp.Message)
+	default:
+		writeServerError(r.Context(), w)
+	}
+}
+
+func (h *restHandler) serveRESTUpdateTodo(w http.ResponseWriter, r *http.Request, id string, uid string) {
+	listID, ok := listParam(w, r)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	body := &restTodoUpdate{}
+	if !readBody(w, r, body, "value") {
+		return
+	}
+	op := &updateOperation{id: id, value: body.Value, attrs: body.todoAttrUpdate}
+	opts := syncOptions{Structured: structuredParam(r)}
+	h.writeRESTMutateTodo(r.Context(), w, h.txMutateTodo(r.Context(), version, id, uid, listID, opts, op))
+}
+
+func (h *restHandler) serveRESTDeleteTodo(w http.ResponseWriter, r *http.Request, id string, uid string) {
+	listID, ok := listParam(w, r)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	op := &deleteOperation{id: id}
+	opts := syncOptions{Structured: structuredParam(r)}
+	h.writeRESTMutateTodo(r.Context(), w, h.txMutateTodo(r.Context(), version, id, uid, listID, opts, op))
+}
+
+// writeRESTMutateTodo writes the response for the given result of
+// txMutateTodo.
+func (h *restHandler) writeRESTMutateTodo(ctx context.Context, w http.ResponseWriter, resp any) {
+	switch resp := resp.(type) {
+	case *mutateTodoResp:
+		writeETag(w, resp.Version)
+		writeJSON(w, resp)
+	case *versionMismatchResp:
+		if resp.Merged {
+			writeETag(w, resp.Version)
+			writeJSON(w, resp)
+			return
+		}
+		writeVersionMismatch(w, resp)
+	case *errorResp:
+		writeError(w, restErrorStatus(resp), resp.Code, resp.Message)
+	default:
+		writeServerError(ctx, w)
+	}
+}
+
+// restErrorStatus returns the HTTP status for an *errorResp returned by a
+// transaction. Most errors mean that the list or todo doesn't exist.
+func restErrorStatus(e *errorResp) int {
+	switch e.Code {
+	case "forbidden":
+		return http.StatusForbidden
+	case "todoExists", "listFull":
+		return http.StatusConflict
+	}
+	return http.StatusNotFound
+}
+
+func (h *restHandler) serveRESTLogin(w http.ResponseWriter, r *http.Request) {
+	body := &loginRqst{}
+	if !readBody(w, r, body, "username", "password") {
+		return
+	}
+	cookie, wait, ok := h.login(r.Context(), body, h.throttles.clientIP(r))
+	if !ok {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if cookie == nil {
+		writeError(w, http.StatusUnauthorized, "invalidCredentials", "the username or password is incorrect")
+		return
+	}
+	http.SetCookie(w, cookie)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *restHandler) serveRESTCreateUser(w http.ResponseWriter, r *http.Request) {
+	body := &createUserRqst{}
+	if !readBody(w, r, body, "username", "password") {
+		return
+	}
+	wait, ok := h.signupWait(r.Context(), h.throttles.clientIP(r))
+	if !ok {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	resp, cookie := h.txCreateUser(r.Context(), body)
+	if resp == nil {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if resp.IsNameTaken {
+		writeError(w, http.StatusConflict, "nameTaken", "the username is already taken")
+		return
+	}
+	http.SetCookie(w, cookie)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *restHandler) serveRESTDeleteUser(w http.ResponseWriter, r *http.Request, uid string) {
+	body := &deleteUserRqst{}
+	if !readBody(w, r, body, "password") {
+		return
+	}
+	deleted, wait, ok := h.deleteUser(r.Context(), uid, body.Password)
+	if !ok {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusUnauthorized, "invalidCredentials", "the password is incorrect")
+		return
+	}
+	h.writeDeleteCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *restHandler) serveRESTChangePassword(w http.ResponseWriter, r *http.Request, uid string) {
+	body := &changePasswordRqst{}
+	if !readBody(w, r, body, "currentPassword", "newPassword") {
+		return
+	}
+	cookie, wait, ok := h.changePassword(r.Context(), uid, body)
+	if !ok {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if cookie == nil {
+		writeError(w, http.StatusUnauthorized, "invalidCredentials", "the password is incorrect")
+		return
+	}
+	http.SetCookie(w, cookie)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *restHandler) serveRESTRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if !h.checkPasswordResetEnabled(w) {
+		return
+	}
+	body := &requestPasswordResetRqst{}
+	if !readBody(w, r, body, "username") {
+		return
+	}
+	wait, ok := h.throttles.passwordResetWait(r.Context(), h.throttles.clientIP(r), body.Username)
+	if !ok {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if !h.requestPasswordReset(r.Context(), body.Username) {
+		writeServerError(r.Context(), w)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *restHandler) serveRESTResetPassword(w http.ResponseWriter, r *http.Request) {
+	if !h.checkPasswordResetEnabled(w) {
+		return
+	}
+	body := &resetPasswordRqst{}
+	if !readBody(w, r, body, "token", "newPassword") {
+		return
+	}
+	reset, wait, ok := h.resetPassword(r.Context(), body.Token, body.NewPassword, h.throttles.clientIP(r))
+	if !ok {
+		writeServerError(r.Context(), w)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if !reset {
+		writeError(w, http.StatusBadRequest, "invalidToken", "the token is invalid, has expired, or was already used")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readBody reads the request body into v, checking that the required fields
+// are present. If the body is invalid, readBody writes an error response and
+// returns false.
+func readBody(w http.ResponseWriter, r *http.Request, v any, required ...string) bool {
+	body, ok := readRqstBody(w, r)
+	if !ok {
+		return false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		writeError(w, http.StatusBadRequest, "malformedRequest", "request body must be a JSON object")
+		return false
+	}
+	if err := checkRequired(fields, required); err != nil {
+		writeError(w, http.StatusBadRequest, "missingField", err.Error())
+		return false
+	}
+	if err := decodeRqst(body, v); err != nil {
+		writeInvalidField(w, err)
+		return false
+	}
+	return true
+}
+
+// readIfMatch parses the todo list version from the request's If-Match
+// header. If the header is missing or malformed, readIfMatch writes an error
+// response and returns false.
+func readIfMatch(w http.ResponseWriter, r *http.Request) (version int32, ok bool) {
+	s := r.Header.Get("If-Match")
+	if s == "" {
+		writeError(w, http.StatusPreconditionRequired, "missingIfMatch",
+			"the If-Match header must contain the todo list version")
+		return 0, false
+	}
+	v, err := strconv.ParseInt(strings.Trim(s, `"`), 10, 32)
+	if err != nil || v < 0 {
+		writeError(w, http.StatusBadRequest, "invalidIfMatch",
+			fmt.Sprintf("the If-Match header %q is not a todo list version", s))
+		return 0, false
+	}
+	return int32(v), true
+}
+
+// listParam returns the listId query parameter (see listRef). If the parameter
+// is malformed, listParam writes an error response and returns false.
+func listParam(w http.ResponseWriter, r *http.Request) (listID string, ok bool) {
+	listID = r.URL.Query().Get("listId")
+	if listID == "" {
+		return "", true
+	}
+	if err := validateListID(listID); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidListId", err.Error())
+		return "", false
+	}
+	return listID, true
+}
+
+// structuredParam reports whether the request's structured query parameter is
+// "true".
+func structuredParam(r *http.Request) bool {
+	return r.URL.Query().Get("structured") == "true"
+}
+
+// writeETag writes a header containing the given todo list version.
+func writeETag(w http.ResponseWriter, version int32) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+}
+
+// writeVersionMismatch writes a 412 response containing the given snapshot.
+func writeVersionMismatch(w http.ResponseWriter, resp *versionMismatchResp) {
+	writeETag(w, resp.Version)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	writeJSON(w, resp)
+}
+
+// writeMethodNotAllowed writes a 405 response listing the allowed methods.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "method not allowed")
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// An operation describes how to serve one value of the "operation" field of
+// an API request.
+type operation struct {
+	// required lists the request fields that must be present (and not null).
+	required []string
+	// requiresLogin indicates that the request's cookie must be verified
+	// before the operation is served.
+	requiresLogin bool
+	// responses lists the JSON response types that the operation sends when
+	// the request is valid. It is only used to document the API, and is empty
+	// for operations that don't send JSON.
+	responses []any
+	// serve decodes the request body and serves the operation.
+	serve rqstServer
+}
+
+// operations maps each value of the "operation" field to the operation that
+// serves it. Adding an operation to the API only requires adding an entry
+// here.
+var operations = map[string]operation{
+	"login": {
+		required:  []string{"username", "password"},
+		responses: []any{&loginResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *loginRqst, _ string) {
+			h.serveLogin(r.Context(), w, rqst, h.throttles.clientIP(r))
+		}),
+	},
+	"logout": {
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, _ *logoutRqst, _ string) {
+			h.serveLogout(w, r)
+		}),
+	},
+	"logoutEverywhere": {
+		requiresLogin: true,
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, _ *logoutEverywhereRqst, uid string) {
+			h.serveLogoutEverywhere(r.Context(), w, uid)
+		}),
+	},
+	"getUsername": {
+		responses: []any{&getUsernameResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, _ *getUsernameRqst, _ string) {
+			h.serveGetUsername(w, r)
+		}),
+	},
+	"createUser": {
+		required:  []string{"username", "password"},
+		responses: []any{&createUserResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *createUserRqst, _ string) {
+			h.serveCreateUser(r.Context(), w, rqst, h.throttles.clientIP(r))
+		}),
+	},
+	"deleteUser": {
+		required:      []string{"password"},
+		requiresLogin: true,
+		responses:     []any{&deleteUserResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *deleteUserRqst, uid string) {
+			h.serveDeleteUser(r.Context(), w, rqst, uid)
+		}),
+	},
+	"changePassword": {
+		required:      []string{"currentPassword", "newPassword"},
+		requiresLogin: true,
+		responses:     []any{&changePasswordResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *changePasswordRqst, uid string) {
+			h.serveChangePassword(r.Context(), w, rqst, uid)
+		}),
+	},
+	"requestPasswordReset": {
+		required: []string{"username"},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *requestPasswordResetRqst, _ string) {
+			h.serveRequestPasswordReset(r.Context(), w, rqst, h.throttles.clientIP(r))
+		}),
+	},
+	"resetPassword": {
+		required:  []string{"token", "newPassword"},
+		responses: []any{&resetPasswordResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *resetPasswordRqst, _ string) {
+			h.serveResetPassword(r.Context(), w, rqst, h.throttles.clientIP(r))
+		}),
+	},
+	"getTodos": {
+		requiresLogin: true,
+		responses:     []any{&getTodosResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *getTodosRqst, uid string) {
+			h.serveGetTodos(r.Context(), w, rqst, uid)
+		}),
+	},
+	"getLists": {
+		requiresLogin: true,
+		responses:     []any{&getListsResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *getListsRqst, uid string) {
+			h.serveGetLists(r.Context(), w, rqst, uid)
+		}),
+	},
+	"createList": {
+		required:      []string{"name"},
+		requiresLogin: true,
+		responses:     []any{&listInfo{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *createListRqst, uid string) {
+			h.serveCreateList(r.Context(), w, rqst, uid)
+		}),
+	},
+	"renameList": {
+		required:      []string{"listId", "name"},
+		requiresLogin: true,
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *renameListRqst, uid string) {
+			h.serveRenameList(r.Context(), w, rqst, uid)
+		}),
+	},
+	"archiveList": {
+		required:      []string{"listId", "archived"},
+		requiresLogin: true,
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *archiveListRqst, uid string) {
+			h.serveArchiveList(r.Context(), w, rqst, uid)
+		}),
+	},
+	"deleteList": {
+		required:      []string{"listId"},
+		requiresLogin: true,
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *deleteListRqst, uid string) {
+			h.serveDeleteList(r.Context(), w, rqst, uid)
+		}),
+	},
+	"shareList": {
+		required:      []string{"listId", "username", "role"},
+		requiresLogin: true,
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *shareListRqst, uid string) {
+			h.serveShareList(r.Context(), w, rqst, uid)
+		}),
+	},
+	"unshareList": {
+		required:      []string{"listId", "username"},
+		requiresLogin: true,
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *unshareListRqst, uid string) {
+			h.serveUnshareList(r.Context(), w, rqst, uid)
+		}),
+	},
+	"getListMembers": {
+		required:      []string{"listId"},
+		requiresLogin: true,
+		responses:     []any{&getListMembersResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *getListMembersRqst, uid string) {
+			h.serveGetListMembers(r.Context(), w, rqst, uid)
+		}),
+	},
+	"deleteTodo": {
+		required:      []string{"version", "id"},
+		requiresLogin: true,
+		responses:     []any{&mutateTodoResp{}, &versionMismatchResp{}, &versionMismatchDeltaResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *deleteTodoRqst, uid string) {
+			h.serveDeleteTodo(r.Context(), w, rqst, uid)
+		}),
+	},
+	"updateTodo": {
+		required:      []string{"version", "id", "value"},
+		requiresLogin: true,
+		responses:     []any{&mutateTodoResp{}, &versionMismatchResp{}, &versionMismatchDeltaResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *updateTodoRqst, uid string) {
+			h.serveUpdateTodo(r.Context(), w, rqst, uid)
+		}),
+	},
+	"moveTodo": {
+		required:      []string{"version", "id"},
+		requiresLogin: true,
+		responses:     []any{&mutateTodoResp{}, &versionMismatchResp{}, &versionMismatchDeltaResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *moveTodoRqst, uid string) {
+			h.serveMoveTodo(r.Context(), w, rqst, uid)
+		}),
+	},
+	"appendTodo": {
+		required:      []string{"version", "id"},
+		requiresLogin: true,
+		responses:     []any{&appendTodoResp{}, &versionMismatchResp{}, &versionMismatchDeltaResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *appendTodoRqst, uid string) {
+			h.serveAppendTodo(r.Context(), w, rqst, uid)
+		}),
+	},
+	"batch": {
+		required:      []string{"version", "ops"},
+		requiresLogin: true,
+		responses:     []any{&batchResp{}, &versionMismatchResp{}, &versionMismatchDeltaResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *batchRqst, uid string) {
+			h.serveBatch(r.Context(), w, rqst, uid)
+		}),
+	},
+	"refreshTodos": {
+		required:      []string{"version"},
+		requiresLogin: true,
+		responses:     []any{&versionMismatchResp{}, &versionMismatchDeltaResp{}},
+		serve: withRqst(func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *refreshTodosRqst, uid string) {
+			h.serveRefreshTodos(r.Context(), w, rqst, uid)
+		}),
+	},
+}
+
+// validator is implemented by request types that have constraints beyond the
+// presence of required fields. validate returns a description of the first
+// problem found, or nil if the request is valid.
+type validator interface {
+	validate() error
+}
+
+// rqstServer decodes and serves requests of a particular type.
+type rqstServer interface {
+	// serveRqst decodes the request body and serves the request. uid is the
+	// logged in user's ID if the operation requires login, or "" otherwise.
+	serveRqst(h *apiHandler, w http.ResponseWriter, r *http.Request, body []byte, uid string)
+	// rqstType returns the type that the request body is decoded into.
+	rqstType() reflect.Type
+}
+
+// typedServer is a function that serves a particular request type. It
+// implements rqstServer.
+type typedServer[T any] func(h *apiHandler, w http.ResponseWriter, r *http.Request, rqst *T, uid string)
+
+// withRqst adapts a function that serves a particular request type into a
+// rqstServer. The rqstServer decodes the request body into a new T and
+// validates it before calling f.
+func withRqst[T any](f typedServer[T]) rqstServer {
+	return f
+}
+
+func (f typedServer[T]) serveRqst(h *apiHandler, w http.ResponseWriter, r *http.Request, body []byte, uid string) {
+	rqst := new(T)
+	if err := decodeRqst(body, rqst); err != nil {
+		writeInvalidField(w, err)
+		return
+	}
+	f(h, w, r, rqst, uid)
+}
+
+func (f typedServer[T]) rqstType() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !h.checkOrigin(w, r) {
+		return
+	}
+	body, ok := readRqstBody(w, r)
+	if !ok {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		writeError(w, http.StatusBadRequest, "malformedRequest", "request body must be a JSON object")
+		return
+	}
+	var name string
+	if err := json.Unmarshal(fields["operation"], &name); err != nil || name == "" {
+		writeError(w, http.StatusBadRequest, "missingField", `missing or invalid field "operation"`)
+		return
+	}
+	op, ok := operations[name]
+	if !ok {
+		log.Printf("received unrecognized operation %q", name)
+		writeError(w, http.StatusBadRequest, "unknownOperation",
+			fmt.Sprintf("unknown operation %q", name))
+		return
+	}
+	w, record := recordRequest(w, name)
+	defer record()
+	if err := checkRequired(fields, op.required); err != nil {
+		writeError(w, http.StatusBadRequest, "missingField", err.Error())
+		return
+	}
+	r, cancel := h.timeouts.withTimeout(r, name)
+	defer cancel()
+	if !op.requiresLogin {
+		op.serve.serveRqst(h, w, r, body, "")
+		return
+	}
+	withVerifyCookie(func(uid string) { op.serve.serveRqst(h, w, r, body, uid) })(h, w, r)
+}
+
+// opTimeouts limits how long each operation may take, so that a slow database
+// doesn't leave requests hanging and pool connections tied up. When the limit
+// passes, the operation's database calls are canceled, and the client receives
+// a "timeout" error (see writeServerError).
+type opTimeouts struct {
+	// def applies to operations that aren't in byOp.
+	def  time.Duration
+	byOp map[string]time.Duration
+}
+
+// loadOpTimeouts returns the timeouts set by OPERATION_TIMEOUT, the default
+// for every operation (10s if it isn't set), and OPERATION_TIMEOUTS, a
+// comma-separated list of overrides for particular operations, each in the form
+// <operation>=<duration> (e.g. "batch=30s,getTodos=5s").
+func loadOpTimeouts() (*opTimeouts, error) {
+	t := &opTimeouts{def: lookupEnvDuration("OPERATION_TIMEOUT", 10*time.Second), byOp: map[string]time.Duration{}}
+	s := os.Getenv("OPERATION_TIMEOUTS")
+	if s == "" {
+		return t, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed timeout %q", entry)
+		}
+		if _, ok := operations[name]; !ok {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("timeout for %v: %w", name, err)
+		}
+		t.byOp[name] = d
+	}
+	return t, nil
+}
+
+// get returns the timeout for the named operation.
+func (t *opTimeouts) get(op string) time.Duration {
+	if d, ok := t.byOp[op]; ok {
+		return d
+	}
+	return t.def
+}
+
+// withTimeout returns a copy of r whose context is canceled when the timeout
+// for the named operation passes, along with a function that releases the
+// context's resources.
+func (t *opTimeouts) withTimeout(r *http.Request, op string) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), t.get(op))
+	return r.WithContext(ctx), cancel
+}
+
+// maxRqstSize is the maximum size of a request body in bytes.
+const maxRqstSize = 1 << 20
+
+// readRqstBody reads the request body. If the body is too large or can't be
+// read, readRqstBody writes an error response and returns false.
+func readRqstBody(w http.ResponseWriter, r *http.Request) (body []byte, ok bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRqstSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, "requestTooLarge",
+			fmt.Sprintf("the request body is larger than %d bytes", maxRqstSize))
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadRequest, "malformedRequest", "failed to read request body")
+		return nil, false
+	}
+	return body, true
+}
+
+// checkRequired returns an error naming the first of the required fields that
+// is missing from (or null in) the given JSON object.
+func checkRequired(fields map[string]json.RawMessage, required []string) error {
+	for _, f := range required {
+		if v, ok := fields[f]; !ok || string(v) == "null" {
+			return fmt.Errorf("missing field %q", f)
+		}
+	}
+	return nil
+}
+
+// decodeRqst decodes the given JSON into v and, if v is a validator,
+// validates the result.
+func decodeRqst(body []byte, v any) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return err
+	}
+	if v, ok := v.(validator); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// writeError writes the given status code along with an errorResp. code is a
+// machine-readable identifier for the error, and message is a human-readable
+// description.
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeErrorResp(w, status, &errorResp{Code: code, Message: message})
+}
+
+// writeInvalidField writes http.StatusBadRequest along with an errorResp for
+// the given validation error. If err is a *fieldError, the errorResp names the
+// field.
+func writeInvalidField(w http.ResponseWriter, err error) {
+	e := &errorResp{Code: "invalidField", Message: err.Error()}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		e.Field = fe.field
+	}
+	writeErrorResp(w, http.StatusBadRequest, e)
+}
+
+func writeErrorResp(w http.ResponseWriter, status int, e *errorResp) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(e)
+	if err != nil {
+		log.Println(err)
+	}
+}
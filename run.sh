@@ -18,4 +18,5 @@ docker run -it --rm \
   -p 8080:8080 \
   -e "JWT_SIGNING_KEY=$JWT_SIGNING_KEY" \
   -e "DB_URL=$DB_URL" \
+  -e "NOTIFICATION_LOG=$NOTIFICATION_LOG" \
   $TAG
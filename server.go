@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// newServer returns a server for http.DefaultServeMux that listens on
+// LISTEN_ADDR (default ":8080"). Its timeouts are set by
+// HTTP_READ_HEADER_TIMEOUT (default 5s), HTTP_READ_TIMEOUT (default 30s),
+// HTTP_WRITE_TIMEOUT (default 30s), and HTTP_IDLE_TIMEOUT (default 120s), so
+// that slow or idle clients can't hold connections open indefinitely. Event
+// streams are exempt from the write timeout (see serveEvents).
+func newServer() *http.Server {
+	addr, ok := os.LookupEnv("LISTEN_ADDR")
+	if !ok {
+		addr = ":8080"
+	}
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: lookupEnvDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       lookupEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      lookupEnvDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       lookupEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+	}
+}
+
+// serveUntilSignaled serves requests until the process receives SIGTERM or
+// SIGINT, and then shuts the server down gracefully. First it closes draining,
+// which fails the readiness check, and keeps serving for SHUTDOWN_DELAY
+// (default 5s) so that load balancers stop sending new requests. Then it stops
+// accepting connections, closes shutdown so that long-lived requests such as
+// event streams end, and waits for in-flight requests to finish. If they don't
+// finish within SHUTDOWN_TIMEOUT (default 20s), their connections are closed.
+// serveUntilSignaled exits the program if the server fails.
+func serveUntilSignaled(server *http.Server, draining chan<- struct{}, shutdown chan<- struct{}) {
+	shutdownDelay := lookupEnvDuration("SHUTDOWN_DELAY", 5*time.Second)
+	shutdownTimeout := lookupEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %v", server.Addr)
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		log.Fatalf("Failed to serve: %v", err)
+	case sig := <-signals:
+		log.Printf("Received %v; shutting down", sig)
+	}
+	close(draining)
+	select {
+	case err := <-errs:
+		log.Fatalf("Failed to serve: %v", err)
+	case sig := <-signals:
+		// A second signal skips the delay.
+		log.Printf("Received %v; shutting down now", sig)
+	case <-time.After(shutdownDelay):
+	}
+	signal.Stop(signals)
+	close(shutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to finish in-flight requests: %v", err)
+		if err := server.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		log.Println(err)
+	}
+}
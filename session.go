@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// A session is created each time a user logs in, and is identified by the
+// "jti" (JWT ID) claim of the access token stored in the user's cookie. Each
+// session is recorded in the sessions table, and a token is only accepted
+// while its session exists and hasn't expired. This allows tokens to be
+// revoked before they expire by deleting the session.
+//
+// Sessions expire after h.sessionLifetime of inactivity. When an active user
+// presents a token that is more than halfway to expiring, the session is
+// extended and a new token is issued.
+
+// sessionClaims are the claims stored in an access token.
+type sessionClaims struct {
+	UID string `json:"uid"`
+	jwt.RegisteredClaims
+}
+
+// errSessionInvalid indicates that an access token was issued by the server
+// but can no longer be used, because its session expired or was revoked.
+var errSessionInvalid = errors.New("session expired or revoked")
+
+// execer is implemented by *dbPool, *pgxpool.Pool, and pgx.Tx.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// createCookie starts a new session for the given user ID and returns a
+// cookie containing the session's access token. db is used to record the
+// session, so that the session can be created as part of a larger
+// transaction. If an error occurs, createCookie logs the error and returns
+// nil.
+func (h *apiHandler) createCookie(ctx context.Context, db execer, uid string) *http.Cookie {
+	now := time.Now()
+	claims := &sessionClaims{
+		UID: uid,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(h.sessionLifetime)),
+		},
+	}
+	// Opportunistically clean up this user's expired sessions, so that the
+	// sessions table doesn't grow without bound.
+	cmd := "DELETE FROM sessions WHERE user_id = $1 AND expires < now()"
+	if _, err := db.Exec(ctx, cmd, uid); err != nil {
+		log.Printf("Failed to delete expired sessions for UID %v: %v", uid, err)
+		return nil
+	}
+	cmd = "INSERT INTO sessions (id, user_id, expires) VALUES ($1, $2, $3)"
+	_, err := db.Exec(ctx, cmd, claims.ID, uid, claims.ExpiresAt.Time)
+	if err != nil {
+		log.Printf("Failed to create session for UID %v: %v", uid, err)
+		return nil
+	}
+	return h.signCookie(claims)
+}
+
+// signCookie signs an access token containing the given claims and returns a
+// cookie containing the token. If an error occurs, signCookie logs the error
+// and returns nil.
+func (h *apiHandler) signCookie(claims *sessionClaims) *http.Cookie {
+	signedString, err := h.jwtKeys.sign(claims)
+	if err != nil {
+		log.Printf("Failed to sign jwt: %v", err)
+		return nil
+	}
+	return h.newCookie(signedString)
+}
+
+// parseToken verifies the signature and expiry of the given access token and
+// returns its claims. It does not check whether the session still exists.
+// parseToken returns errSessionInvalid if the token has expired or predates
+// sessions.
+func (h *apiHandler) parseToken(tokenString string) (*sessionClaims, error) {
+	claims := &sessionClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		claims,
+		h.jwtKeys.keyFunc,
+		jwt.WithValidMethods(h.jwtKeys.validMethods()),
+	)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, errSessionInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		// The token was issued before sessions were introduced.
+		return nil, errSessionInvalid
+	}
+	return claims, nil
+}
+
+// checkSession verifies the given access token and checks that its session
+// hasn't been revoked, returning the token's claims. If the session is more
+// than halfway to expiring, checkSession extends it and writes a header
+// instructing the client to replace its cookie.
+//
+// checkSession returns errSessionInvalid if the token can no longer be used.
+// Any other error indicates either a token that the server didn't issue or a
+// database failure.
+func (h *apiHandler) checkSession(ctx context.Context, w http.ResponseWriter, tokenString string) (*sessionClaims, error) {
+	claims, err := h.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT FROM sessions WHERE id = $1 AND user_id = $2 AND expires > now()"
+	err = h.pool.QueryRow(ctx, query, claims.ID, claims.UID).Scan()
+	if err == pgx.ErrNoRows {
+		return nil, errSessionInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Until(claims.ExpiresAt.Time) < h.sessionLifetime/2 {
+		h.refreshSession(ctx, w, claims)
+	}
+	return claims, nil
+}
+
+// refreshSession extends the given session and writes a header instructing
+// the client to store a new access token. Failing to refresh the session is
+// not fatal, since the current token is still valid, so refreshSession only
+// logs errors.
+func (h *apiHandler) refreshSession(ctx context.Context, w http.ResponseWriter, claims *sessionClaims) {
+	expires := time.Now().Add(h.sessionLifetime)
+	cmd := "UPDATE sessions SET expires = $1 WHERE id = $2"
+	if _, err := h.pool.Exec(ctx, cmd, expires, claims.ID); err != nil {
+		log.Printf("Failed to refresh session %v: %v", claims.ID, err)
+		return
+	}
+	claims.ExpiresAt = jwt.NewNumericDate(expires)
+	if cookie := h.signCookie(claims); cookie != nil {
+		http.SetCookie(w, cookie)
+	}
+}
+
+// revokeSession deletes the session with the given ID. If an error occurs,
+// revokeSession logs the error and returns false.
+func revokeSession(ctx context.Context, db execer, id string) bool {
+	cmd := "DELETE FROM sessions WHERE id = $1"
+	if _, err := db.Exec(ctx, cmd, id); err != nil {
+		log.Printf("Failed to revoke session %v: %v", id, err)
+		return false
+	}
+	return true
+}
+
+// revokeAllSessions deletes every session belonging to the given user ID. If
+// an error occurs, revokeAllSessions logs the error and returns false.
+func revokeAllSessions(ctx context.Context, db execer, uid string) bool {
+	cmd := "DELETE FROM sessions WHERE user_id = $1"
+	if _, err := db.Exec(ctx, cmd, uid); err != nil {
+		log.Printf("Failed to revoke sessions for UID %v: %v", uid, err)
+		return false
+	}
+	return true
+}
+
+// serveLogout revokes the session identified by the request's cookie, if
+// there is one, and instructs the client to delete the cookie.
+func (h *apiHandler) serveLogout(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(h.cookieName)
+	if err != nil {
+		// Already logged out.
+		return
+	}
+	h.writeDeleteCookie(w)
+	claims, err := h.parseToken(c.Value)
+	if err != nil {
+		// There is no usable session to revoke.
+		return
+	}
+	if !revokeSession(r.Context(), h.pool, claims.ID) {
+		writeServerError(r.Context(), w)
+	}
+}
+
+// serveLogoutEverywhere revokes every session belonging to the given user,
+// including the current one, and instructs the client to delete its cookie.
+func (h *apiHandler) serveLogoutEverywhere(ctx context.Context, w http.ResponseWriter, uid string) {
+	if !revokeAllSessions(ctx, h.pool, uid) {
+		writeServerError(ctx, w)
+		return
+	}
+	h.writeDeleteCookie(w)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Login attempts are throttled per username and per client IP address, so
+// that passwords can't be guessed as fast as requests can be sent. After a
+// few failed attempts, each further failure blocks the username or address
+// for an exponentially increasing delay, and after many failures, it is
+// locked out for a longer period. A successful login resets the username's
+// failures. Account creation is throttled per address in the same way, with
+// every creation counting as a failure, and so are password reset requests,
+// per address and per username, and attempts to redeem invalid reset tokens,
+// per address. Logged in users' attempts to confirm their
+// password count as failed logins.
+//
+// Each attempt is counted as a failure before it is checked, and taken back
+// if it succeeds, so that a client can't send many attempts at once and have
+// them all checked before the first failure is recorded.
+//
+// Blocked requests receive 429 Too Many Requests with a Retry-After header.
+// The failures are recorded in a throttleStore, which is kept in memory or,
+// so that every instance sees the same failures, in PostgreSQL.
+
+// A throttle applies a backoff policy to the failures recorded in a store.
+type throttle struct {
+	store throttleStore
+	// prefix distinguishes this throttle's keys from those of other
+	// throttles that share the store.
+	prefix string
+	// free is the number of failures that are allowed before delays start.
+	free int
+	// baseDelay is the delay after the first failure beyond free. Each
+	// further failure doubles the delay, up to maxDelay.
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	// After lockoutFailures failures, the key is locked out for
+	// lockoutDuration.
+	lockoutFailures int
+	lockoutDuration time.Duration
+	// Failures are forgotten once forget has passed since the last one.
+	forget time.Duration
+}
+
+// delay returns how long a key is blocked after the given number of
+// failures.
+func (t *throttle) delay(failures int) time.Duration {
+	if failures >= t.lockoutFailures {
+		return t.lockoutDuration
+	}
+	n := failures - t.free
+	if n <= 0 {
+		return 0
+	}
+	d := float64(t.baseDelay) * math.Pow(2, float64(n-1))
+	if d > float64(t.maxDelay) {
+		return t.maxDelay
+	}
+	return time.Duration(d)
+}
+
+// attempt returns how long the given key must wait before its next attempt,
+// or, if it needn't wait, counts the attempt as a failure and returns 0.
+func (t *throttle) attempt(ctx context.Context, key string) (time.Duration, error) {
+	return t.store.attempt(ctx, t.prefix+key, t.delay, t.forget)
+}
+
+// release takes back an attempt that succeeded.
+func (t *throttle) release(ctx context.Context, key string) error {
+	return t.store.release(ctx, t.prefix+key, t.delay)
+}
+
+func (t *throttle) reset(ctx context.Context, key string) error {
+	return t.store.reset(ctx, t.prefix+key)
+}
+
+func (t *throttle) resetTx(ctx context.Context, tx pgx.Tx, key string) error {
+	return t.store.resetTx(ctx, tx, t.prefix+key)
+}
+
+// A throttleStore records the failures of each key.
+type throttleStore interface {
+	// attempt returns how long the given key is still blocked. If it isn't
+	// blocked, attempt increments the key's failure count, blocks the key
+	// for delay(count), and returns 0, all in one step. The count restarts
+	// at 1 if the previous failure happened more than forget ago.
+	attempt(ctx context.Context, key string, delay func(failures int) time.Duration, forget time.Duration) (time.Duration, error)
+	// release decrements the given key's failure count, and shortens its
+	// block to delay(count) from now.
+	release(ctx context.Context, key string, delay func(failures int) time.Duration) error
+	// reset forgets the given key's failures.
+	reset(ctx context.Context, key string) error
+	// resetTx forgets the given key's failures when tx commits. Stores that
+	// can't take part in tx forget them immediately.
+	resetTx(ctx context.Context, tx pgx.Tx, key string) error
+}
+
+// memoryThrottleStore keeps failures in memory. It is only suitable for a
+// single instance.
+type memoryThrottleStore struct {
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+	// lastSweep is when forgotten entries were last deleted.
+	lastSweep time.Time
+}
+
+type throttleEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+func newMemoryThrottleStore() *memoryThrottleStore {
+	return &memoryThrottleStore{entries: map[string]*throttleEntry{}, lastSweep: time.Now()}
+}
+
+func (s *memoryThrottleStore) attempt(_ context.Context, key string, delay func(int) time.Duration, forget time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > forget {
+		for k, e := range s.entries {
+			if now.Sub(e.lastFailure) > forget && now.After(e.blockedUntil) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	e, ok := s.entries[key]
+	if ok && now.Before(e.blockedUntil) {
+		return e.blockedUntil.Sub(now), nil
+	}
+	if !ok || now.Sub(e.lastFailure) > forget {
+		e = &throttleEntry{}
+		s.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	e.blockedUntil = now.Add(delay(e.failures))
+	return 0, nil
+}
+
+func (s *memoryThrottleStore) release(_ context.Context, key string, delay func(int) time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	e.failures--
+	if e.failures <= 0 {
+		delete(s.entries, key)
+		return nil
+	}
+	if until := time.Now().Add(delay(e.failures)); until.Before(e.blockedUntil) {
+		e.blockedUntil = until
+	}
+	return nil
+}
+
+func (s *memoryThrottleStore) reset(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *memoryThrottleStore) resetTx(ctx context.Context, _ pgx.Tx, key string) error {
+	return s.reset(ctx, key)
+}
+
+// pgThrottleStore keeps failures in the login_throttle table, so that they
+// are shared by every instance.
+type pgThrottleStore struct {
+	pool *dbPool
+	mu   sync.Mutex
+	// lastSweep is when this instance last deleted forgotten rows.
+	lastSweep time.Time
+}
+
+func (s *pgThrottleStore) attempt(ctx context.Context, key string, delay func(int) time.Duration, forget time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	sweep := time.Since(s.lastSweep) > forget
+	if sweep {
+		s.lastSweep = time.Now()
+	}
+	s.mu.Unlock()
+	if sweep {
+		cmd := "DELETE FROM login_throttle WHERE last_failure < now() - $1::interval AND blocked_until < now()"
+		if _, err := s.pool.Exec(ctx, cmd, forget); err != nil {
+			return 0, err
+		}
+	}
+	// Locking the row makes concurrent attempts for the key wait for each
+	// other, so each one sees the failures counted by those before it.
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rollback(tx)
+	cmd := `
+		INSERT INTO login_throttle (key, failures, last_failure, blocked_until)
+		VALUES ($1, 0, now(), now())
+		ON CONFLICT (key) DO NOTHING`
+	if _, err := tx.Exec(ctx, cmd, key); err != nil {
+		return 0, err
+	}
+	var failures int
+	var forgotten bool
+	var wait float64
+	query := `
+		SELECT failures, last_failure < now() - $2::interval,
+			greatest(extract(epoch FROM blocked_until - now()), 0)::float8
+		FROM login_throttle WHERE key = $1 FOR UPDATE`
+	if err := tx.QueryRow(ctx, query, key, forget).Scan(&failures, &forgotten, &wait); err != nil {
+		return 0, err
+	}
+	if wait > 0 {
+		return time.Duration(wait * float64(time.Second)), nil
+	}
+	if forgotten {
+		failures = 0
+	}
+	failures++
+	cmd = `
+		UPDATE login_throttle
+		SET failures = $2, last_failure = now(), blocked_until = now() + $3::interval
+		WHERE key = $1`
+	if _, err := tx.Exec(ctx, cmd, key, failures, delay(failures)); err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit(ctx)
+}
+
+func (s *pgThrottleStore) release(ctx context.Context, key string, delay func(int) time.Duration) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+	var failures int
+	query := "SELECT failures FROM login_throttle WHERE key = $1 FOR UPDATE"
+	err = tx.QueryRow(ctx, query, key).Scan(&failures)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	failures--
+	if failures <= 0 {
+		_, err = tx.Exec(ctx, "DELETE FROM login_throttle WHERE key = $1", key)
+	} else {
+		cmd := `
+			UPDATE login_throttle
+			SET failures = $2, blocked_until = least(blocked_until, now() + $3::interval)
+			WHERE key = $1`
+		_, err = tx.Exec(ctx, cmd, key, failures, delay(failures))
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *pgThrottleStore) reset(ctx context.Context, key string) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM login_throttle WHERE key = $1", key)
+	return err
+}
+
+func (s *pgThrottleStore) resetTx(ctx context.Context, tx pgx.Tx, key string) error {
+	_, err := tx.Exec(ctx, "DELETE FROM login_throttle WHERE key = $1", key)
+	return err
+}
+
+// newThrottleStore returns the store named by THROTTLE_STORE, which is either
+// "memory" (the default) or "postgres".
+func newThrottleStore(pool *dbPool) (throttleStore, error) {
+	name, ok := os.LookupEnv("THROTTLE_STORE")
+	if !ok || name == "memory" {
+		return newMemoryThrottleStore(), nil
+	}
+	if name == "postgres" {
+		return &pgThrottleStore{pool: pool, lastSweep: time.Now()}, nil
+	}
+	return nil, fmt.Errorf("unknown throttle store %q", name)
+}
+
+// loginThrottles are the throttles that apply to logins and account creation.
+type loginThrottles struct {
+	// user throttles failed logins per username.
+	user *throttle
+	// ip throttles failed logins per client address.
+	ip *throttle
+	// signup throttles account creation per client address.
+	signup *throttle
+	// resetUser and resetIP throttle password reset requests per username
+	// and per client address.
+	resetUser *throttle
+	resetIP   *throttle
+	// resetToken throttles invalid password reset tokens per client address.
+	resetToken *throttle
+	// ipHeader is the request header that holds the client address, or ""
+	// if the address of the connection is the client's.
+	ipHeader string
+	// proxyWarning logs, once, that a request came through a proxy although
+	// ipHeader isn't set.
+	proxyWarning sync.Once
+}
+
+func newLoginThrottles(store throttleStore) *loginThrottles {
+	ipHeader := os.Getenv("CLIENT_IP_HEADER")
+	if ipHeader == "" {
+		log.Println("CLIENT_IP_HEADER not set; using the address of each connection as the client address. Set it if the application runs behind a proxy.")
+	}
+	return &loginThrottles{
+		user: &throttle{
+			store:           store,
+			prefix:          "user:",
+			free:            3,
+			baseDelay:       time.Second,
+			maxDelay:        time.Minute,
+			lockoutFailures: 10,
+			lockoutDuration: 15 * time.Minute,
+			forget:          time.Hour,
+		},
+		ip: &throttle{
+			store:           store,
+			prefix:          "ip:",
+			free:            10,
+			baseDelay:       time.Second,
+			maxDelay:        time.Minute,
+			lockoutFailures: 50,
+			lockoutDuration: 15 * time.Minute,
+			forget:          time.Hour,
+		},
+		signup: &throttle{
+			store:           store,
+			prefix:          "signup:",
+			free:            5,
+			baseDelay:       time.Minute,
+			maxDelay:        time.Hour,
+			lockoutFailures: 20,
+			lockoutDuration: 24 * time.Hour,
+			forget:          24 * time.Hour,
+		},
+		resetUser: &throttle{
+			store:           store,
+			prefix:          "reset:",
+			free:            3,
+			baseDelay:       time.Minute,
+			maxDelay:        time.Hour,
+			lockoutFailures: 10,
+			lockoutDuration: 24 * time.Hour,
+			forget:          24 * time.Hour,
+		},
+		resetIP: &throttle{
+			store:           store,
+			prefix:          "resetip:",
+			free:            10,
+			baseDelay:       time.Minute,
+			maxDelay:        time.Hour,
+			lockoutFailures: 50,
+			lockoutDuration: 24 * time.Hour,
+			forget:          24 * time.Hour,
+		},
+		resetToken: &throttle{
+			store:           store,
+			prefix:          "token:",
+			free:            10,
+			baseDelay:       time.Second,
+			maxDelay:        time.Minute,
+			lockoutFailures: 50,
+			lockoutDuration: 15 * time.Minute,
+			forget:          time.Hour,
+		},
+		ipHeader: ipHeader,
+	}
+}
+
+// clientIP returns the address of the client that sent the request. If
+// ipHeader is set, the last address in that header is used, which is the one
+// added by the proxy in front of the server.
+//
+// If ipHeader isn't set and the connection comes from a private address, the
+// request almost certainly came through a proxy, such as a load balancer, and
+// the address is shared by every client. The address is still used, so that
+// requests are throttled rather than not at all, but clientIP logs a warning,
+// since a few clients can then lock everyone out.
+func (t *loginThrottles) clientIP(r *http.Request) string {
+	if t.ipHeader != "" {
+		if v := r.Header.Values(t.ipHeader); len(v) > 0 {
+			addrs := strings.Split(v[len(v)-1], ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if t.ipHeader == "" {
+		if ip := net.ParseIP(host); ip != nil && ip.IsPrivate() {
+			t.proxyWarning.Do(func() {
+				log.Printf("Request from private address %v, which is probably a proxy; set CLIENT_IP_HEADER to throttle requests per client address", host)
+			})
+		}
+	}
+	return host
+}
+
+// A throttleKey is a key of a particular throttle.
+type throttleKey struct {
+	t   *throttle
+	key string
+}
+
+// attemptAll counts an attempt for each of the given keys (see
+// throttle.attempt). If a key must wait, the attempts counted for the keys
+// before it are released, and wait is how long that key must wait. If an
+// error occurs, attemptAll logs the error and sets ok to false.
+func attemptAll(ctx context.Context, keys ...throttleKey) (wait time.Duration, ok bool) {
+	for i, k := range keys {
+		d, err := k.t.attempt(ctx, k.key)
+		if err != nil {
+			log.Printf("Failed to check throttle for \"%v%v\": %v", k.t.prefix, k.key, err)
+			releaseAll(ctx, keys[:i]...)
+			return 0, false
+		}
+		if d > 0 {
+			releaseAll(ctx, keys[:i]...)
+			return d, true
+		}
+	}
+	return 0, true
+}
+
+// releaseAll releases an attempt for each of the given keys. Errors are
+// logged, since they shouldn't prevent a response.
+func releaseAll(ctx context.Context, keys ...throttleKey) {
+	for _, k := range keys {
+		if err := k.t.release(ctx, k.key); err != nil {
+			log.Printf("Failed to release throttle attempt for \"%v%v\": %v", k.t.prefix, k.key, err)
+		}
+	}
+}
+
+// loginAttempt returns how long a client must wait before attempting to log
+// in as the given user, and counts the attempt as a failure if it needn't
+// wait. If an error occurs, loginAttempt logs the error and sets ok to false.
+func (t *loginThrottles) loginAttempt(ctx context.Context, ip string, username string) (wait time.Duration, ok bool) {
+	return attemptAll(ctx, throttleKey{t.ip, ip}, throttleKey{t.user, username})
+}
+
+// passwordResetWait returns how long a client must wait before requesting a
+// password reset token for the given user, and counts the request if it
+// needn't wait. If an error occurs, passwordResetWait logs the error and sets
+// ok to false.
+func (t *loginThrottles) passwordResetWait(ctx context.Context, ip string, username string) (wait time.Duration, ok bool) {
+	return attemptAll(ctx, throttleKey{t.resetIP, ip}, throttleKey{t.resetUser, username})
+}
+
+// resetTokenAttempt returns how long a client at the given IP address must
+// wait before redeeming a password reset token, and counts the attempt as a
+// failure if it needn't wait. If an error occurs, resetTokenAttempt logs the
+// error and sets ok to false.
+func (t *loginThrottles) resetTokenAttempt(ctx context.Context, ip string) (wait time.Duration, ok bool) {
+	return attemptAll(ctx, throttleKey{t.resetToken, ip})
+}
+
+// resetTokenRedeemed takes back the address's attempt to redeem a token,
+// since the token was valid.
+func (t *loginThrottles) resetTokenRedeemed(ctx context.Context, ip string) {
+	releaseAll(ctx, throttleKey{t.resetToken, ip})
+}
+
+// passwordAttempt returns how long a logged in client must wait before
+// checking the given user's password, and counts the attempt as a failed
+// login if it needn't wait. If an error occurs, passwordAttempt logs the
+// error and sets ok to false.
+func (t *loginThrottles) passwordAttempt(ctx context.Context, username string) (wait time.Duration, ok bool) {
+	return attemptAll(ctx, throttleKey{t.user, username})
+}
+
+// passwordMatched forgets the failed attempts to log in as the given user.
+// Errors are logged, since they shouldn't prevent a response.
+func (t *loginThrottles) passwordMatched(ctx context.Context, username string) {
+	if err := t.user.reset(ctx, username); err != nil {
+		log.Printf("Failed to reset login throttle for name \"%v\": %v", username, err)
+	}
+}
+
+// loginSucceeded forgets the failed attempts to log in as the given user, and
+// takes back the address's attempt. The address's earlier failures are kept,
+// so that a client can't reset them by logging in to its own account between
+// guesses.
+func (t *loginThrottles) loginSucceeded(ctx context.Context, ip string, username string) {
+	t.passwordMatched(ctx, username)
+	releaseAll(ctx, throttleKey{t.ip, ip})
+}
+
+// userDeleted forgets the failures recorded for the given username as part of
+// tx, which deletes the user, so that they don't apply to a new user with the
+// same name. If an error occurs, userDeleted logs the error and returns
+// false.
+func (t *loginThrottles) userDeleted(ctx context.Context, tx pgx.Tx, username string) bool {
+	for _, th := range []*throttle{t.user, t.resetUser} {
+		if err := th.resetTx(ctx, tx, username); err != nil {
+			log.Printf("Failed to reset throttle for \"%v%v\": %v", th.prefix, username, err)
+			return false
+		}
+	}
+	return true
+}
+
+// writeTooManyRequests writes a response telling the client to retry after
+// the given delay.
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, "tooManyAttempts",
+		fmt.Sprintf("too many attempts; try again in %v seconds", seconds))
+}
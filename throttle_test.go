@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	th := &throttle{
+		free:            3,
+		baseDelay:       time.Second,
+		maxDelay:        10 * time.Second,
+		lockoutFailures: 10,
+		lockoutDuration: time.Hour,
+	}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := th.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%v) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryThrottleStore(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryThrottleStore()
+	// Block the key for an hour from the third failure on.
+	delay := func(failures int) time.Duration {
+		if failures >= 3 {
+			return time.Hour
+		}
+		return 0
+	}
+	attempt := func(key string) time.Duration {
+		t.Helper()
+		wait, err := s.attempt(ctx, key, delay, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wait
+	}
+
+	for i := 1; i <= 3; i++ {
+		if wait := attempt("a"); wait != 0 {
+			t.Fatalf("attempt %v waited %v", i, wait)
+		}
+	}
+	if wait := attempt("a"); wait <= 59*time.Minute || wait > time.Hour {
+		t.Fatalf("attempt after lockout waited %v, want about an hour", wait)
+	}
+	if wait := attempt("b"); wait != 0 {
+		t.Fatalf("other key waited %v", wait)
+	}
+
+	// Releasing the third attempt lifts the block, and another failure
+	// restores it.
+	if err := s.release(ctx, "a", delay); err != nil {
+		t.Fatal(err)
+	}
+	if wait := attempt("a"); wait != 0 {
+		t.Fatalf("attempt after release waited %v", wait)
+	}
+	if wait := attempt("a"); wait == 0 {
+		t.Fatal("attempt after another failure wasn't blocked")
+	}
+
+	if err := s.reset(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if wait := attempt("a"); wait != 0 {
+		t.Fatalf("attempt after reset waited %v", wait)
+	}
+}
+
+func TestMemoryThrottleStoreForget(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryThrottleStore()
+	delay := func(failures int) time.Duration {
+		if failures >= 2 {
+			return time.Hour
+		}
+		return 0
+	}
+	const forget = 10 * time.Millisecond
+	if _, err := s.attempt(ctx, "a", delay, forget); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * forget)
+	// The first failure has been forgotten, so this is the first again.
+	if _, err := s.attempt(ctx, "a", delay, forget); err != nil {
+		t.Fatal(err)
+	}
+	wait, err := s.attempt(ctx, "a", delay, forget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 {
+		t.Fatalf("attempt after forgotten failure waited %v", wait)
+	}
+	if n := s.entries["a"].failures; n != 2 {
+		t.Fatalf("failures = %v, want 2", n)
+	}
+}
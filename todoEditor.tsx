@@ -30,6 +30,8 @@ export const TodoEditor = memo(function TodoEditor({ ts }: TodoEditorProps) {
     []
   );
 
+  useEffect(() => ts.listen(), []);
+
   const [, setState] = useState({});
   useEffect(
     () => ts.subscribeToKeys(() => setState({})),
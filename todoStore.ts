@@ -1,4 +1,4 @@
-import { RawTodos } from "./actions";
+import { RawTodos, TodoChange } from "./actions";
 import { noop } from "./noop";
 
 export type TodoStore = ReturnType<typeof createTodoStore>;
@@ -85,6 +85,28 @@ export function createTodoStore(todos: RawTodos) {
     keySubscriber();
   }
 
+  /**
+   * applyChanges removes deleted todos, updates the values of existing todos,
+   * and appends new todos, in the order given.
+   */
+  function applyChanges(changes: TodoChange[]) {
+    let keysChanged = false;
+    for (const { id, value, deleted } of changes) {
+      if (deleted) {
+        keysChanged = todoMap.delete(id) || keysChanged;
+        continue;
+      }
+      if (!todoMap.has(id)) {
+        keysChanged = true;
+      }
+      todoMap.set(id, value);
+      valueSubscriberMap.get(id)?.();
+    }
+    if (keysChanged) {
+      keySubscriber();
+    }
+  }
+
   return {
     subscribeToKeys,
     subscribeToValue,
@@ -94,7 +116,8 @@ export function createTodoStore(todos: RawTodos) {
     update,
     appendNew,
     remove,
-    replaceAll
+    replaceAll,
+    applyChanges
   }
 }
 
@@ -1,4 +1,4 @@
-import { Actions, RawTodos, TodosSnapshot } from "./actions";
+import { Actions, RawTodos, TodosDelta, TodosSnapshot } from "./actions";
 import { TaskQueue } from "./taskQueue";
 import { createTodoStore } from "./todoStore";
 
@@ -40,6 +40,41 @@ export function createTodoSynchronizer({
     });
   }
 
+  /**
+   * listen keeps the todos up-to-date with changes that the server reports,
+   * e.g. from another browser. Changes that follow our version are applied
+   * directly. Otherwise, if the server reports a version other than ours, the
+   * todos are refreshed, which fetches only the todos that changed. listen
+   * returns a function that stops listening.
+   */
+  function listen() {
+    return actions.subscribeToChanges({
+      onVersionReceived: (r) => {
+        if (r.version !== version) {
+          refresh();
+        }
+      },
+      onChangesReceived: (r) => {
+        if (r.version === version) {
+          return;
+        }
+        // Apply the changes in turn with our own operations, which may change
+        // the version in the meantime.
+        taskQueue.addTask({
+          run: async () => {
+            if (r.since === version) {
+              version = r.version;
+              todoStore.applyChanges(r.changes);
+            } else if (r.version !== version) {
+              await actions.refreshTodos(createCommonArgs());
+            }
+          },
+          isSync: true
+        });
+      }
+    });
+  }
+
   async function remove(id: string) {
     todoStore.remove(id);
     taskQueue.addTask({
@@ -94,6 +129,10 @@ export function createTodoSynchronizer({
         version = r.version;
         todoStore.replaceAll(r.todos);
       },
+      onChangesReceived: (r: TodosDelta) => {
+        version = r.version;
+        todoStore.applyChanges(r.changes);
+      },
       onResultReceived: (r: { version: number }) => version = r.version
     };
   }
@@ -104,6 +143,7 @@ export function createTodoSynchronizer({
     get: todoStore.get,
     ids: todoStore.ids,
     refresh,
+    listen,
     remove,
     appendNew,
     update
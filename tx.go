@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Every transaction runs at the serializable isolation level, so PostgreSQL
+// aborts one of two concurrent transactions that would otherwise interfere
+// with each other (e.g. two tabs editing the same list). Such transactions are
+// retried from the start, after a short random delay, a bounded number of
+// times.
+
+const (
+	// maxTxAttempts is the number of times that a transaction is attempted
+	// before giving up.
+	maxTxAttempts = 5
+	// txRetryDelay is the delay before the first retry. Each further retry
+	// doubles the delay, up to maxTxRetryDelay.
+	txRetryDelay    = 10 * time.Millisecond
+	maxTxRetryDelay = 200 * time.Millisecond
+)
+
+var (
+	txRetries = newCounterVec("todo_db_transaction_retries_total",
+		"Transactions retried after a serialization failure or deadlock, by SQLSTATE.", "sqlstate")
+	txFailures = newCounterVec("todo_db_transaction_failures_total",
+		"Transactions that failed, by reason (\"error\", \"timeout\" or \"retries_exhausted\").", "reason")
+)
+
+// runTx starts a serializable transaction with the given access mode and
+// calls f, which must commit the transaction if it should take effect. f
+// returns false if an error occurs. If f fails because of a serialization
+// failure or deadlock, runTx calls it again in a new transaction, so f must
+// not have side effects outside the transaction. If an error occurs, runTx
+// logs the error and returns false. The transaction is abandoned when ctx is
+// done.
+func (h *apiHandler) runTx(ctx context.Context, mode pgx.TxAccessMode, f func(tx pgx.Tx) bool) bool {
+	for attempt := 1; ; attempt++ {
+		tx, err := h.pool.BeginTx(ctx, pgx.TxOptions{
+			IsoLevel:       pgx.Serializable,
+			AccessMode:     mode,
+			DeferrableMode: pgx.NotDeferrable,
+		})
+		if err != nil {
+			log.Printf("Failed to start transaction: %v", err)
+			txFailures.inc(txFailureReason(ctx))
+			return false
+		}
+		rtx := &retryTx{Tx: tx}
+		ok := f(rtx)
+		rollback(tx)
+		if ok {
+			return true
+		}
+		var pgErr *pgconn.PgError
+		if !errors.As(rtx.err, &pgErr) {
+			txFailures.inc(txFailureReason(ctx))
+			return false
+		}
+		if attempt == maxTxAttempts {
+			log.Printf("Giving up on transaction after %v attempts", attempt)
+			txFailures.inc("retries_exhausted")
+			return false
+		}
+		log.Printf("Retrying transaction (attempt %v) after %v", attempt+1, pgErr.Code)
+		txRetries.inc(pgErr.Code)
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-ctx.Done():
+			txFailures.inc(txFailureReason(ctx))
+			return false
+		}
+	}
+}
+
+// txFailureReason returns the reason that a transaction failed for the
+// txFailures metric.
+func txFailureReason(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return "error"
+}
+
+// retryDelay returns a random delay before retrying a transaction that
+// failed on the given attempt. The randomness keeps transactions that
+// conflicted with each other from conflicting again.
+func retryDelay(attempt int) time.Duration {
+	d := txRetryDelay << (attempt - 1)
+	if d > maxTxRetryDelay {
+		d = maxTxRetryDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isRetryable returns whether err means that the transaction was aborted
+// because of concurrent transactions, and may succeed if retried.
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// serialization_failure and deadlock_detected
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+// retryTx is a transaction that remembers the first error that was returned
+// by one of its statements and can be fixed by retrying the transaction.
+// Callers log and discard errors, so this is how runTx finds out about them.
+type retryTx struct {
+	pgx.Tx
+	err error
+}
+
+func (t *retryTx) check(err error) error {
+	if t.err == nil && isRetryable(err) {
+		t.err = err
+	}
+	return err
+}
+
+func (t *retryTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	ct, err := t.Tx.Exec(ctx, sql, args...)
+	return ct, t.check(err)
+}
+
+func (t *retryTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	rows, err := t.Tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, t.check(err)
+	}
+	return &retryRows{Rows: rows, tx: t}, nil
+}
+
+func (t *retryTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &retryRow{row: t.Tx.QueryRow(ctx, sql, args...), tx: t}
+}
+
+func (t *retryTx) Commit(ctx context.Context) error {
+	return t.check(t.Tx.Commit(ctx))
+}
+
+type retryRows struct {
+	pgx.Rows
+	tx *retryTx
+}
+
+func (r *retryRows) Err() error {
+	return r.tx.check(r.Rows.Err())
+}
+
+type retryRow struct {
+	row pgx.Row
+	tx  *retryTx
+}
+
+func (r *retryRow) Scan(dest ...any) error {
+	return r.tx.check(r.row.Scan(dest...))
+}